@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// hasFileSystem reports whether blkid finds any signature on device, a file
+// system or e.g. an LVM physical volume.
+func (awsAsgEbs *AwsAsgEbs) hasFileSystem(device string) (bool, error) {
+	_, err := awsAsgEbs.commandRunner().Capture("/sbin/blkid", "-p", device)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("blkid %s: %w", device, err)
+	}
+	return true, nil
+}
+
+// blkidValue returns the value of tag, e.g. TYPE, that blkid reports for
+// device.
+func (awsAsgEbs *AwsAsgEbs) blkidValue(device string, tag string) (string, error) {
+	out, err := awsAsgEbs.commandRunner().Capture("/sbin/blkid", "-o", "value", "-s", tag, device)
+	if err != nil {
+		return "", fmt.Errorf("blkid %s: %w", device, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// fileSystemType returns the type of the file system on device.
+func (awsAsgEbs *AwsAsgEbs) fileSystemType(device string) (string, error) {
+	return awsAsgEbs.blkidValue(device, "TYPE")
+}
+
+// fileSystemUUID returns the UUID of the file system on device.
+func (awsAsgEbs *AwsAsgEbs) fileSystemUUID(device string) (string, error) {
+	return awsAsgEbs.blkidValue(device, "UUID")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// With --multi-attach all instances share one io1 or io2 volume with a
+// cluster file system. Exactly one of them may create and format it, the
+// others only attach it once it has a file system.
+//
+// EC2 has no conditional writes, so the creator is elected after the fact:
+// every instance that finds no volume creates one, waits clusterSettleDelay
+// until the volumes of the other instances are visible as well and keeps
+// the oldest. The others delete their volume and attach the oldest.
+var (
+	clusterSettleDelay  = 15 * time.Second
+	clusterPollInterval = 5 * time.Second
+)
+
+// clusterFileSystemTypes can be mounted by several instances at once. Both
+// need a running cluster stack (dlm with corosync or o2cb) on every instance.
+var clusterFileSystemTypes = []string{"gfs2", "ocfs2"}
+
+func isClusterFileSystem(fsType string) bool {
+	for _, t := range clusterFileSystemTypes {
+		if t == fsType {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLockTable checks the CLUSTER:FSNAME lock table of gfs2.
+func validateLockTable(lockTable string) error {
+	parts := strings.Split(lockTable, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid lock table '%s', must be CLUSTER:FSNAME", lockTable)
+	}
+	return nil
+}
+
+// ByVolumeId sorts volumes by id.
+type ByVolumeId []*ec2.Volume
+
+func (v ByVolumeId) Len() int      { return len(v) }
+func (v ByVolumeId) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v ByVolumeId) Less(i, j int) bool {
+	return aws.StringValue(v[i].VolumeId) < aws.StringValue(v[j].VolumeId)
+}
+
+// findClusterVolumes returns the volumes with the tag in the availability
+// zone, attached or not, oldest first and by id on the same creation time,
+// so all instances agree on the first one.
+func (awsAsgEbs *AwsAsgEbs) findClusterVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagKey),
+				Values: []*string{aws.String(tagValue)},
+			},
+			{
+				Name:   aws.String("status"),
+				Values: []*string{aws.String("creating"), aws.String("available"), aws.String("in-use")},
+			},
+			{
+				Name:   aws.String("availability-zone"),
+				Values: []*string{aws.String(awsAsgEbs.AvailabilityZone)},
+			},
+		},
+	}
+	volumes := []*ec2.Volume{}
+	err := svc.DescribeVolumesPages(describeVolumesInput, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		volumes = append(volumes, page.Volumes...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByVolumeId(volumes))
+	sortVolumes(volumes, "oldest")
+	return volumes, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) deleteVolume(volumeId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	deleteVolumeInput := &ec2.DeleteVolumeInput{
+		VolumeId: aws.String(volumeId),
+	}
+	_, err := svc.DeleteVolume(deleteVolumeInput)
+	return err
+}
+
+// waitUntilFileSystemCreated polls the filesystem tag of the volume until
+// the instance that created it tagged it as formatted.
+func (awsAsgEbs *AwsAsgEbs) waitUntilFileSystemCreated(volumeId string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		tags, err := awsAsgEbs.volumeTags(volumeId)
+		if err != nil {
+			return err
+		}
+		if tags[awsAsgEbs.filesystemTag()] == "true" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("volume %s has no file system after %s", volumeId, timeout)
+		}
+		log.WithFields(log.Fields{"volume": volumeId}).Debug("Waiting for the file system of the cluster volume")
+		time.Sleep(clusterPollInterval)
+	}
+}
+
+// attachClusterVolume attaches the shared volume with the tag, creating it
+// if no instance did yet. It returns whether this instance created the
+// volume and has to create the file system.
+func attachClusterVolume(asgEbs AsgEbs, cfg Config) (*string, bool, error) {
+	volume, err := asgEbs.findAttachedVolume(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		return nil, false, wrapError(ErrVolumeLookupFailed, err)
+	}
+	if volume != nil {
+		log.WithFields(log.Fields{"volume": aws.StringValue(volume.VolumeId)}).Info("Cluster volume is already attached")
+		return volume.VolumeId, false, nil
+	}
+
+	volumes, err := asgEbs.findClusterVolumes(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		return nil, false, wrapError(ErrVolumeLookupFailed, err)
+	}
+	creator := false
+	if len(volumes) == 0 {
+		created, err := createClusterVolume(asgEbs, cfg)
+		if err != nil {
+			return nil, false, err
+		}
+		volumes, err = findClusterVolumesWith(asgEbs, cfg, *created)
+		if err != nil {
+			return nil, false, wrapError(ErrVolumeLookupFailed, err)
+		}
+		if aws.StringValue(volumes[0].VolumeId) == *created {
+			log.WithFields(log.Fields{"volume": *created}).Info("Created the cluster volume")
+			creator = true
+		} else {
+			log.WithFields(log.Fields{"volume": *created, "cluster_volume": aws.StringValue(volumes[0].VolumeId)}).Info("Another instance created the cluster volume first, deleting ours")
+			err = asgEbs.deleteVolume(*created)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": *created}).Warn("Failed to delete volume")
+			}
+		}
+	}
+	volumeId := volumes[0].VolumeId
+
+	if !creator {
+		log.WithFields(log.Fields{"volume": *volumeId}).Info("Waiting until the cluster volume has a file system")
+		err = asgEbs.waitUntilFileSystemCreated(*volumeId, *cfg.clusterWaitTimeout)
+		if err != nil {
+			return nil, false, wrapError(ErrVolumeNotAvailable, err)
+		}
+	}
+
+	log.WithFields(log.Fields{"volume": *volumeId, "device": *cfg.attachAs}).Info("Attaching cluster volume")
+	err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, false)
+	if err != nil {
+		return nil, false, wrapError(ErrAttachFailed, fmt.Errorf("volume %s: %w", *volumeId, err))
+	}
+	metrics.increment("volumes.attached")
+	return volumeId, creator, nil
+}
+
+// createClusterVolume creates a multi-attach volume and waits until it and
+// the volumes other instances may have created at the same time are
+// visible.
+func createClusterVolume(asgEbs AsgEbs, cfg Config) (*string, error) {
+	log.Info("No cluster volume found, creating one")
+	volumeId, err := createVolumeWithCapacityRetry(asgEbs, cfg, nil)
+	if err != nil {
+		return nil, wrapError(ErrCreateFailed, err)
+	}
+	metrics.increment("volumes.created")
+	err = asgEbs.waitUntilVolumeAvailable(*volumeId)
+	if err != nil {
+		return nil, wrapError(ErrVolumeNotAvailable, fmt.Errorf("volume %s: %w", *volumeId, err))
+	}
+	time.Sleep(clusterSettleDelay)
+	return volumeId, nil
+}
+
+// findClusterVolumesWith returns the cluster volumes once the volume this
+// instance created is among them. Without it, the election could pick a
+// volume another instance is about to delete.
+func findClusterVolumesWith(asgEbs AsgEbs, cfg Config, volumeId string) ([]*ec2.Volume, error) {
+	deadline := time.Now().Add(*cfg.clusterWaitTimeout)
+	for {
+		volumes, err := asgEbs.findClusterVolumes(*cfg.tagKey, *cfg.tagValue)
+		if err != nil {
+			return nil, err
+		}
+		for _, volume := range volumes {
+			if aws.StringValue(volume.VolumeId) == volumeId {
+				return volumes, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("volume %s is not found by its tag %s=%s after %s", volumeId, *cfg.tagKey, *cfg.tagValue, *cfg.clusterWaitTimeout)
+		}
+		time.Sleep(clusterPollInterval)
+	}
+}
+
+// validateMultiAttach returns the problems of --multi-attach with the other
+// flags.
+func validateMultiAttach(cfg Config) []error {
+	problems := []error{}
+	if !supportsMultiAttach(*cfg.createVolumeType) {
+		problems = append(problems, fmt.Errorf("--multi-attach is not supported for %s volumes, use io1 or io2", *cfg.createVolumeType))
+	}
+	if !isClusterFileSystem(*cfg.filesystemType) {
+		problems = append(problems, fmt.Errorf("--multi-attach requires a cluster file system, set --filesystem-type to %s", strings.Join(clusterFileSystemTypes, " or ")))
+	}
+	if *cfg.cloneVolumeId != "" || len(snapshotTags(cfg)) > 0 {
+		problems = append(problems, errors.New("--multi-attach cannot create volumes from snapshots"))
+	}
+	if *cfg.thinPool {
+		problems = append(problems, errors.New("--multi-attach and --thin-pool are mutually exclusive"))
+	}
+	if *cfg.deleteOnTermination {
+		problems = append(problems, errors.New("--multi-attach and --delete-on-termination are mutually exclusive"))
+	}
+	return problems
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newClusterConfig() *Config {
+	cfg := newConfig()
+	cfg.multiAttach = boolPtr(true)
+	cfg.createVolumeType = strPtr("io2")
+	cfg.createIops = int64Ptr(3000)
+	cfg.filesystemType = strPtr("gfs2")
+	cfg.clusterLockTable = strPtr("web:data")
+	cfg.deleteOnTermination = boolPtr(false)
+	return cfg
+}
+
+func newClusterFakeAsgEbs(cfg *Config) *FakeAsgEbs {
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.
+		On("findAttachedVolume", *cfg.tagKey, *cfg.tagValue).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("attachVolume", mock.AnythingOfType("string"), *cfg.attachAs, false).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("main.mkfsConfig"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	return fakeAsgEbs
+}
+
+func TestValidateConfigMultiAttach(t *testing.T) {
+	assert.Empty(t, validateConfig(*newClusterConfig()))
+
+	cfg := newClusterConfig()
+	cfg.createVolumeType = strPtr("gp3")
+	cfg.createIops = int64Ptr(0)
+	cfg.filesystemType = strPtr("ext4")
+	cfg.deleteOnTermination = boolPtr(true)
+	assert.Len(t, validateConfig(*cfg), 3)
+
+	cfg = newClusterConfig()
+	cfg.clusterLockTable = strPtr("data")
+	assert.Len(t, validateConfig(*cfg), 1)
+
+	cfg = newClusterConfig()
+	cfg.multiAttach = boolPtr(false)
+	assert.Len(t, validateConfig(*cfg), 1)
+}
+
+func TestAttachClusterVolumeCreatesAndFormats(t *testing.T) {
+	defer func(delay time.Duration) { clusterSettleDelay = delay }(clusterSettleDelay)
+	clusterSettleDelay = 0
+	cfg := newClusterConfig()
+	fakeAsgEbs := newClusterFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findClusterVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{}, nil).Once()
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("findClusterVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{{VolumeId: aws.String(defaultVolumeId)}, {VolumeId: aws.String("vol-newer")}}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
+
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, false)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/"+*cfg.attachAs, newMkfsConfig(*cfg), defaultVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "deleteVolume", mock.Anything)
+	fakeAsgEbs.AssertNotCalled(t, "waitUntilFileSystemCreated", mock.Anything, mock.Anything)
+}
+
+func TestAttachClusterVolumeLosesElection(t *testing.T) {
+	defer func(delay time.Duration) { clusterSettleDelay = delay }(clusterSettleDelay)
+	clusterSettleDelay = 0
+	cfg := newClusterConfig()
+	fakeAsgEbs := newClusterFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findClusterVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{}, nil).Once()
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return("vol-newer", nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", "vol-newer").
+		Return(nil)
+	fakeAsgEbs.
+		On("findClusterVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{{VolumeId: aws.String(defaultVolumeId)}, {VolumeId: aws.String("vol-newer")}}, nil)
+	fakeAsgEbs.
+		On("deleteVolume", "vol-newer").
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilFileSystemCreated", defaultVolumeId, *cfg.clusterWaitTimeout).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
+
+	fakeAsgEbs.AssertCalled(t, "deleteVolume", "vol-newer")
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, false)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAttachClusterVolumeNeverFormatsExistingVolume(t *testing.T) {
+	cfg := newClusterConfig()
+	fakeAsgEbs := newClusterFakeAsgEbs(cfg)
+	fakeAsgEbs.NoFileSystem = true
+
+	fakeAsgEbs.
+		On("findClusterVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{{VolumeId: aws.String(defaultVolumeId)}}, nil)
+	fakeAsgEbs.
+		On("waitUntilFileSystemCreated", defaultVolumeId, *cfg.clusterWaitTimeout).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.Error(t, err)
+
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", mock.Anything, mock.Anything, mock.Anything)
+	fakeAsgEbs.AssertNotCalled(t, "mountVolume", mock.Anything, mock.Anything)
+}
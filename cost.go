@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// pricingRegion is the only region the prices below are for. Prices differ
+// between regions, the estimate is meant to notice an accidentally huge
+// volume and not to be a bill.
+const pricingRegion = "us-east-1"
+
+// volumePricePerGiBMonth are the us-east-1 list prices in USD.
+var volumePricePerGiBMonth = map[string]float64{
+	"standard": 0.05,
+	"gp2":      0.10,
+	"gp3":      0.08,
+	"io1":      0.125,
+	"io2":      0.125,
+}
+
+// provisionedPrice is the monthly price in USD per provisioned IOPS or MiB/s
+// above what the volume type includes for free.
+type provisionedPrice struct {
+	included int64
+	price    float64
+}
+
+// iopsPricePerMonth and throughputPricePerMonth are the us-east-1 list
+// prices of provisioned performance. io2 gets cheaper above 32000 IOPS, so
+// the estimate errs on the high side there.
+var (
+	iopsPricePerMonth = map[string]provisionedPrice{
+		"gp3": {included: 3000, price: 0.005},
+		"io1": {price: 0.065},
+		"io2": {price: 0.065},
+	}
+	throughputPricePerMonth = map[string]provisionedPrice{
+		"gp3": {included: 125, price: 0.04},
+	}
+)
+
+func (p provisionedPrice) cost(provisioned int64) float64 {
+	if provisioned <= p.included {
+		return 0
+	}
+	return float64(provisioned-p.included) * p.price
+}
+
+// expensiveVolumeCost is the estimated monthly cost in USD above which the
+// estimate is logged as a warning.
+var expensiveVolumeCost = 500.0
+
+// estimateMonthlyCost returns the cost of the storage plus the provisioned
+// IOPS and throughput in MiB/s, 0 for the default of the volume type.
+func estimateMonthlyCost(size int64, volumeType string, iops int64, throughput int64) (float64, bool) {
+	price, ok := volumePricePerGiBMonth[volumeType]
+	if !ok {
+		return 0, false
+	}
+	cost := float64(size) * price
+	cost += iopsPricePerMonth[volumeType].cost(iops)
+	cost += throughputPricePerMonth[volumeType].cost(throughput)
+	return cost, true
+}
+
+func logCostEstimate(size int64, volumeType string, iops int64, throughput int64) {
+	cost, ok := estimateMonthlyCost(size, volumeType, iops, throughput)
+	if !ok {
+		log.WithFields(log.Fields{"size": size, "volume_type": volumeType}).Info("No price known for volume type")
+		return
+	}
+	entry := log.WithFields(log.Fields{"size": size, "volume_type": volumeType, "iops": iops, "throughput": throughput, "monthly_cost_usd": fmt.Sprintf("%.2f", cost), "price_region": pricingRegion})
+	if cost > expensiveVolumeCost {
+		entry.Warn("New volume is expensive")
+		return
+	}
+	entry.Info("Estimated cost of new volume at us-east-1 prices")
+}
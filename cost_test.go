@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateMonthlyCost(t *testing.T) {
+	cost, ok := estimateMonthlyCost(200, "gp2", 0, 0)
+	assert.True(t, ok)
+	assert.InDelta(t, 20.0, cost, 0.001)
+
+	_, ok = estimateMonthlyCost(200, "sc1", 0, 0)
+	assert.False(t, ok)
+}
+
+func TestEstimateMonthlyCostOfProvisionedPerformance(t *testing.T) {
+	// The baseline of gp3 is included.
+	cost, _ := estimateMonthlyCost(100, "gp3", 3000, 125)
+	assert.InDelta(t, 8.0, cost, 0.001)
+
+	cost, _ = estimateMonthlyCost(100, "gp3", 4000, 250)
+	assert.InDelta(t, 8.0+5.0+5.0, cost, 0.001)
+
+	cost, _ = estimateMonthlyCost(1000, "io2", 64000, 0)
+	assert.InDelta(t, 125.0+4160.0, cost, 0.001)
+	assert.True(t, cost > expensiveVolumeCost)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// releaseVolume undoes runAsgEbs: it clears the readiness tag, unmounts the
+// bind mounts, the overlay and the volume by mount point, closes the
+// dm-verity device, deactivates the thin pool and detaches the volume
+// attached as --attach-as. It waits at most --detach-timeout until the
+// volume is available again.
+func releaseVolume(asgEbs AsgEbs, cfg Config) error {
+	volumeId, isRoot, err := asgEbs.attachedVolume(*cfg.attachAs)
+	if err != nil {
+		return err
+	}
+	if volumeId == nil {
+		return fmt.Errorf("no volume attached as %s", *cfg.attachAs)
+	}
+	if isRoot {
+		return fmt.Errorf("refusing to release root volume %s", *volumeId)
+	}
+
+	if cfg.readinessTag.Key != "" {
+		log.WithFields(log.Fields{"volume": *volumeId, "tag_key": cfg.readinessTag.Key}).Info("Clearing readiness tag")
+		err = asgEbs.deleteTag(*volumeId, cfg.readinessTag.Key)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Warn("Failed to clear readiness tag")
+		}
+	}
+
+	// The volume is unmounted by mount point, with --thin-pool the mount
+	// source is the thin volume and not the device of the volume.
+	mountPoints := append([]string{*cfg.mountPoint}, *cfg.bindMountPoints...)
+	if *cfg.overlayLowerDir != "" {
+		mountPoints = append([]string{*cfg.overlayVolumeMountPoint}, mountPoints...)
+	}
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		log.WithFields(log.Fields{"mount_point": mountPoints[i]}).Info("Unmounting")
+		err = asgEbs.unmount(mountPoints[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if *cfg.verityRootHash != "" {
+		log.WithFields(log.Fields{"volume": *volumeId}).Info("Closing dm-verity device")
+		err = asgEbs.closeVerity(*volumeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *cfg.thinPool {
+		log.WithFields(log.Fields{"volume": *volumeId}).Info("Deactivating thin pool")
+		err = asgEbs.deactivateThinPool(*volumeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *cfg.snapshotOnExit {
+		snapshotBeforeDetach(asgEbs, cfg, *volumeId)
+	}
+
+	// Clearing DeleteOnTermination first keeps the volume even if the
+	// instance is terminated before the detach is completed.
+	if *cfg.detachOnExit {
+		log.WithFields(log.Fields{"volume": *volumeId}).Info("Keeping volume on instance termination")
+		err = asgEbs.setDeleteOnTermination(*volumeId, *cfg.attachAs, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{"volume": *volumeId}).Info("Detaching volume")
+	err = detachAndWait(asgEbs, *volumeId, *cfg.detachTimeout)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"volume": *volumeId}).Info("Detached volume")
+	return nil
+}
+
+// snapshotBeforeDetach snapshots the unmounted volume, tagged like the
+// volume is searched for. Failures are only logged, the volume is detached
+// anyway.
+func snapshotBeforeDetach(asgEbs AsgEbs, cfg Config, volumeId string) {
+	tags := map[string]string{
+		*cfg.tagKey:     *cfg.tagValue,
+		"snapshot-time": time.Now().UTC().Format(time.RFC3339),
+	}
+	log.WithFields(log.Fields{"volume": volumeId}).Info("Creating snapshot before detaching")
+	snapshotId, err := asgEbs.createSnapshot(volumeId, "asg-ebs snapshot on exit of "+volumeId, tags)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to create snapshot, detaching anyway")
+		return
+	}
+	log.WithFields(log.Fields{"volume": volumeId, "snapshot": *snapshotId}).Info("Created snapshot")
+	if !*cfg.waitForSnapshot {
+		return
+	}
+	log.WithFields(log.Fields{"volume": volumeId, "snapshot": *snapshotId}).Info("Waiting until snapshot is completed")
+	err = asgEbs.waitUntilSnapshotCompleted(*snapshotId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot": *snapshotId}).Error("Snapshot did not complete, detaching anyway")
+		return
+	}
+	log.WithFields(log.Fields{"volume": volumeId, "snapshot": *snapshotId}).Info("Snapshot completed")
+}
+
+// credentialCheckWarnFailures is the number of failed credential checks in a
+// row after which the daemon warns that releasing the volume may fail.
+var credentialCheckWarnFailures = 3
+
+// checkCredentials describes the volume to find out whether the credentials
+// still work. On failure the credentials are expired, so the next request
+// fetches them again instead of waiting for them to expire.
+func (awsAsgEbs *AwsAsgEbs) checkCredentials(volumeId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	}
+	_, err := svc.DescribeVolumes(describeVolumesInput)
+	if err != nil && awsAsgEbs.AwsConfig != nil && awsAsgEbs.AwsConfig.Credentials != nil {
+		awsAsgEbs.AwsConfig.Credentials.Expire()
+	}
+	return err
+}
+
+// credentialCheck runs the periodic credential checks of the daemon and
+// counts the failures in a row.
+type credentialCheck struct {
+	asgEbs   AsgEbs
+	volumeId string
+	failures int
+}
+
+func (check *credentialCheck) run() {
+	err := check.asgEbs.checkCredentials(check.volumeId)
+	if err == nil {
+		if check.failures > 0 {
+			log.WithFields(log.Fields{"volume": check.volumeId, "failures": check.failures}).Info("Credential check succeeded again")
+		}
+		check.failures = 0
+		return
+	}
+	check.failures++
+	metrics.increment("credentials.check_failed")
+	prometheusMetrics.increment("asg_ebs_credential_check_failures_total", nil)
+	fields := log.Fields{"error": err, "volume": check.volumeId, "failures": check.failures}
+	if check.failures >= credentialCheckWarnFailures {
+		log.WithFields(fields).Error("Credential check failed repeatedly, releasing the volume will fail unless the credentials recover")
+		return
+	}
+	log.WithFields(fields).Warn("Credential check failed")
+}
+
+// runDaemon blocks until SIGTERM or SIGINT and then releases the volume.
+// Meanwhile it checks every --credential-check-interval that the AWS
+// credentials still work, so the calls on shutdown do not fail unnoticed.
+func runDaemon(asgEbs AsgEbs, cfg Config) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	var ticks <-chan time.Time
+	var check *credentialCheck
+	if *cfg.credentialCheckInterval > 0 {
+		volumeId, _, err := asgEbs.attachedVolume(*cfg.attachAs)
+		if err != nil || volumeId == nil {
+			log.WithFields(log.Fields{"error": err, "device": *cfg.attachAs}).Warn("Failed to find the attached volume, not checking credentials")
+		} else {
+			check = &credentialCheck{asgEbs: asgEbs, volumeId: *volumeId}
+			ticker := time.NewTicker(*cfg.credentialCheckInterval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+	}
+
+	log.Info("Volume provided, waiting for SIGTERM or SIGINT to release it")
+	for {
+		select {
+		case sig := <-signals:
+			log.WithFields(log.Fields{"signal": sig}).Info("Releasing volume")
+			return releaseVolume(asgEbs, cfg)
+		case <-ticks:
+			check.run()
+		}
+	}
+}
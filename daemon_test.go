@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReleaseVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.bindMountPoints = &[]string{"/srv/data", "/var/lib/app"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	var order []string
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("unmount", "/var/lib/app").Return(nil).Run(func(args mock.Arguments) { order = append(order, "/var/lib/app") })
+	fakeAsgEbs.On("unmount", "/srv/data").Return(nil).Run(func(args mock.Arguments) { order = append(order, "/srv/data") })
+	fakeAsgEbs.On("unmount", *cfg.mountPoint).Return(nil).Run(func(args mock.Arguments) { order = append(order, *cfg.mountPoint) })
+	fakeAsgEbs.On("detachVolume", defaultVolumeId).Return(nil)
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).Return(nil)
+
+	assert.NoError(t, releaseVolume(fakeAsgEbs, *cfg))
+	assert.Equal(t, []string{"/var/lib/app", "/srv/data", *cfg.mountPoint}, order)
+	fakeAsgEbs.AssertCalled(t, "detachVolume", defaultVolumeId)
+}
+
+func TestReleaseVolumeWithThinPoolAndReadinessTag(t *testing.T) {
+	cfg := newConfig()
+	cfg.thinPool = boolPtr(true)
+	cfg.readinessTag = &TagValue{Key: "data-ready", Value: "true"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	var order []string
+	record := func(step string) func(mock.Arguments) {
+		return func(args mock.Arguments) { order = append(order, step) }
+	}
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("deleteTag", defaultVolumeId, "data-ready").Return(nil).Run(record("deleteTag"))
+	fakeAsgEbs.On("unmount", *cfg.mountPoint).Return(nil).Run(record("unmount"))
+	fakeAsgEbs.On("deactivateThinPool", defaultVolumeId).Return(nil).Run(record("deactivateThinPool"))
+	fakeAsgEbs.On("detachVolume", defaultVolumeId).Return(nil).Run(record("detachVolume"))
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).Return(nil)
+
+	assert.NoError(t, releaseVolume(fakeAsgEbs, *cfg))
+	assert.Equal(t, []string{"deleteTag", "unmount", "deactivateThinPool", "detachVolume"}, order)
+}
+
+func TestReleaseVolumeDetachOnExit(t *testing.T) {
+	cfg := newConfig()
+	cfg.daemon = boolPtr(true)
+	cfg.detachOnExit = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	var order []string
+	record := func(step string) func(mock.Arguments) {
+		return func(args mock.Arguments) { order = append(order, step) }
+	}
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("unmount", *cfg.mountPoint).Return(nil)
+	fakeAsgEbs.On("setDeleteOnTermination", defaultVolumeId, *cfg.attachAs, false).Return(nil).Run(record("setDeleteOnTermination"))
+	fakeAsgEbs.On("detachVolume", defaultVolumeId).Return(nil).Run(record("detachVolume"))
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).Return(nil)
+
+	assert.NoError(t, releaseVolume(fakeAsgEbs, *cfg))
+	assert.Equal(t, []string{"setDeleteOnTermination", "detachVolume"}, order)
+}
+
+func TestReleaseVolumeDetachTimeout(t *testing.T) {
+	cfg := newConfig()
+	cfg.detachTimeout = durationPtr(10 * time.Millisecond)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("unmount", *cfg.mountPoint).Return(nil)
+	fakeAsgEbs.On("detachVolume", defaultVolumeId).Return(nil)
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).After(time.Second).Return(nil)
+
+	err := releaseVolume(fakeAsgEbs, *cfg)
+	assert.True(t, errors.Is(err, ErrVolumeNotAvailable))
+}
+
+func TestReleaseVolumeRefusesRootVolume(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, true, nil)
+
+	assert.Error(t, releaseVolume(fakeAsgEbs, *cfg))
+	fakeAsgEbs.AssertNotCalled(t, "detachVolume", defaultVolumeId)
+}
+
+func TestReleaseVolumeSnapshotFailureStillDetaches(t *testing.T) {
+	cfg := newConfig()
+	cfg.daemon = boolPtr(true)
+	cfg.snapshotOnExit = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	hasSearchTag := mock.MatchedBy(func(tags map[string]string) bool {
+		return tags[*cfg.tagKey] == *cfg.tagValue && tags["snapshot-time"] != ""
+	})
+	fakeAsgEbs.On("attachedVolume", *cfg.attachAs).Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("unmount", *cfg.mountPoint).Return(nil)
+	fakeAsgEbs.On("createSnapshot", defaultVolumeId, mock.AnythingOfType("string"), hasSearchTag).Return(nil, errors.New("SnapshotLimitExceeded"))
+	fakeAsgEbs.On("detachVolume", defaultVolumeId).Return(nil)
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).Return(nil)
+
+	assert.NoError(t, releaseVolume(fakeAsgEbs, *cfg))
+	fakeAsgEbs.AssertCalled(t, "createSnapshot", defaultVolumeId, mock.AnythingOfType("string"), hasSearchTag)
+	fakeAsgEbs.AssertCalled(t, "detachVolume", defaultVolumeId)
+}
+
+func TestCredentialCheckCountsFailuresInARow(t *testing.T) {
+	defer func(registry *prometheusRegistry) { prometheusMetrics = registry }(prometheusMetrics)
+	prometheusMetrics = newPrometheusRegistry()
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("checkCredentials", defaultVolumeId).Return(errors.New("ExpiredToken")).Twice()
+	fakeAsgEbs.On("checkCredentials", defaultVolumeId).Return(nil)
+
+	check := &credentialCheck{asgEbs: fakeAsgEbs, volumeId: defaultVolumeId}
+	check.run()
+	check.run()
+	assert.Equal(t, 2, check.failures)
+	check.run()
+	assert.Equal(t, 0, check.failures)
+
+	var out bytes.Buffer
+	prometheusMetrics.write(&out)
+	assert.Contains(t, out.String(), "asg_ebs_credential_check_failures_total 2\n")
+}
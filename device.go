@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// byIdPath returns the udev symlink for an EBS volume attached via NVMe,
+// e.g. /dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0.
+func byIdPath(volumeId string) string {
+	return "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_" + strings.Replace(volumeId, "-", "", 1)
+}
+
+// biosVendorFile holds the DMI BIOS vendor, "Amazon EC2" on Nitro and "Xen"
+// on Xen instances.
+var biosVendorFile = "/sys/devices/virtual/dmi/id/bios_vendor"
+
+// isNitro reports whether the instance runs on Nitro, where EBS volumes show
+// up as NVMe devices instead of under the device name they were attached as.
+// Only the BIOS vendor "Amazon EC2" means Nitro. Anything else, including a
+// missing, empty or unreadable file, means Xen.
+func isNitro() bool {
+	content, err := os.ReadFile(biosVendorFile)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": biosVendorFile}).Warn("Failed to read BIOS vendor, assuming Xen")
+		return false
+	}
+	return strings.TrimSpace(string(content)) == "Amazon EC2"
+}
+
+// expectedDevice returns where a volume attached as attachAs shows up. Xen
+// renames sd* devices to xvd*, Nitro names NVMe devices in attach order, so
+// there only the by-id link identifies the volume.
+func expectedDevice(volumeId string, attachAs string, nitro bool) string {
+	if nitro {
+		return byIdPath(volumeId)
+	}
+	if strings.HasPrefix(attachAs, "sd") {
+		attachAs = "xvd" + strings.TrimPrefix(attachAs, "sd")
+	}
+	return "/dev/" + attachAs
+}
+
+// normalizeDeviceName maps the names a block device mapping can use for
+// the same disk (/dev/sda1, sda, xvda) to one name (xvda).
+func normalizeDeviceName(device string) string {
+	device = strings.TrimPrefix(device, "/dev/")
+	if strings.HasPrefix(device, "sd") {
+		device = "xvd" + strings.TrimPrefix(device, "sd")
+	}
+	return strings.TrimRight(device, "0123456789")
+}
+
+func isRootDevice(attachAs string, rootDevice string) bool {
+	return normalizeDeviceName(attachAs) == normalizeDeviceName(rootDevice)
+}
+
+// nextFreeDevice returns the first of the conventional EBS device names
+// xvdf to xvdp that is not in use.
+func nextFreeDevice(used []string) (string, error) {
+	taken := map[string]bool{}
+	for _, device := range used {
+		taken[normalizeDeviceName(device)] = true
+	}
+	for c := 'f'; c <= 'p'; c++ {
+		device := "xvd" + string(c)
+		if !taken[device] {
+			return device, nil
+		}
+	}
+	return "", errors.New("no free device name between xvdf and xvdp")
+}
+
+// mappedDevices returns the device names of the instance's block device
+// mappings from the instance metadata.
+func (awsAsgEbs *AwsAsgEbs) mappedDevices() ([]string, error) {
+	mappings, err := awsAsgEbs.Metadata.GetMetadata("block-device-mapping/")
+	if err != nil {
+		return nil, err
+	}
+	devices := []string{}
+	for _, mapping := range strings.Fields(mappings) {
+		device, err := awsAsgEbs.Metadata.GetMetadata("block-device-mapping/" + mapping)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// resolveNvmeDevice returns the NVMe device, e.g. /dev/nvme1n1, the by-id
+// link of a volume points to, or the link itself if it cannot be resolved.
+func resolveNvmeDevice(byId string) string {
+	device, err := filepath.EvalSymlinks(byId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "device": byId}).Warn("Failed to resolve NVMe device, using by-id link")
+		return byId
+	}
+	return device
+}
+
+// attachedDevice returns the device of the volume attached as attachAs, or
+// the device it would show up as if none is. On Nitro the device is not
+// named after attachAs, so the attached volume is looked up.
+func (awsAsgEbs *AwsAsgEbs) attachedDevice(attachAs string) (string, error) {
+	if !awsAsgEbs.Nitro {
+		return expectedDevice("", attachAs, false), nil
+	}
+	volumeId, _, err := awsAsgEbs.attachedVolume(attachAs)
+	if err != nil {
+		return "", err
+	}
+	if volumeId == nil {
+		return "/dev/" + attachAs, nil
+	}
+	return awsAsgEbs.devicePath(*volumeId, attachAs), nil
+}
+
+// devicePath returns the path makeFileSystem and mountVolume use for the
+// attached volume. On Nitro that is the NVMe device of the volume, on Xen
+// the expected device. With UseById it is the stable by-id symlink if udev
+// created one.
+func (awsAsgEbs *AwsAsgEbs) devicePath(volumeId string, attachAs string) string {
+	device := expectedDevice(volumeId, attachAs, awsAsgEbs.Nitro)
+	if awsAsgEbs.Nitro {
+		if awsAsgEbs.UseById {
+			return device
+		}
+		nvmeDevice := resolveNvmeDevice(device)
+		log.WithFields(log.Fields{"volume": volumeId, "device": nvmeDevice}).Info("Using NVMe device")
+		return nvmeDevice
+	}
+	if !awsAsgEbs.UseById {
+		return device
+	}
+	byId := byIdPath(volumeId)
+	err := waitForFile(byId, 10*time.Second, awsAsgEbs.DevicePollInterval)
+	if err != nil {
+		log.WithFields(log.Fields{"volume": volumeId, "device": device}).Info("No by-id device link, using requested device name")
+		return device
+	}
+	log.WithFields(log.Fields{"volume": volumeId, "device": byId}).Info("Using by-id device link")
+	return byId
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Failure classes returned by runAsgEbs. The underlying cause is wrapped,
+// so callers can use errors.Is to branch on the class and still inspect
+// the original error.
+var (
+	ErrPrecondition       = errors.New("precondition failed")
+	ErrVolumeLookupFailed = errors.New("volume lookup failed")
+	ErrCreateFailed       = errors.New("volume creation failed")
+	ErrVolumeNotAvailable = errors.New("volume not available")
+	ErrAttachFailed       = errors.New("volume attach failed")
+	ErrFormatFailed       = errors.New("file system creation failed")
+	ErrMountFailed        = errors.New("volume mount failed")
+	ErrResizeFailed       = errors.New("file system resize failed")
+	ErrSnapshotFailed     = errors.New("snapshot failed")
+	ErrMetadataFailed     = errors.New("instance metadata not available")
+	ErrConfig             = errors.New("invalid configuration")
+)
+
+// exitCodes are the exit codes of attach for the failure classes, so that
+// callers can tell them apart. Other failures exit with 1.
+var exitCodes = []struct {
+	class error
+	code  int
+}{
+	{ErrMetadataFailed, 2},
+	{ErrPrecondition, 3},
+	{ErrVolumeLookupFailed, 4},
+	{ErrCreateFailed, 5},
+	{ErrVolumeNotAvailable, 6},
+	{ErrAttachFailed, 7},
+	{ErrFormatFailed, 8},
+	{ErrMountFailed, 9},
+	{ErrResizeFailed, 10},
+	{ErrSnapshotFailed, 11},
+	{ErrConfig, 12},
+}
+
+func exitCode(err error) int {
+	for _, exit := range exitCodes {
+		if errors.Is(err, exit.class) {
+			return exit.code
+		}
+	}
+	return 1
+}
+
+func wrapError(class error, err error) error {
+	return fmt.Errorf("%w: %w", class, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const fstabFile = "/etc/fstab"
+
+// fstabEntry returns the fstab line mounting the file system with uuid. It
+// is mounted nofail, so booting does not block when the volume is gone,
+// e.g. because it was attached to another instance meanwhile.
+func fstabEntry(uuid string, mountPoint string, fsType string, options []string) string {
+	options = append([]string{"defaults"}, options...)
+	options = append(options, "nofail")
+	return fmt.Sprintf("UUID=%s %s %s %s 0 2", uuid, mountPoint, fsType, strings.Join(options, ","))
+}
+
+// updateFstab returns content with entry in place of the lines mounting
+// uuid or mounting at mountPoint, or with entry appended if there are none.
+func updateFstab(content string, entry string, uuid string, mountPoint string) string {
+	lines := []string{}
+	existing := []string{}
+	if content != "" {
+		existing = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+	replaced := false
+	for _, line := range existing {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") && (fields[0] == "UUID="+uuid || fields[1] == mountPoint) {
+			if !replaced {
+				lines = append(lines, entry)
+				replaced = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !replaced {
+		lines = append(lines, entry)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// persistMount adds the mount of device at mountPoint to /etc/fstab so it
+// survives a reboot. The file is replaced, which fails where the root file
+// system is read-only.
+func (awsAsgEbs *AwsAsgEbs) persistMount(device string, mountPoint string) error {
+	uuid, err := awsAsgEbs.fileSystemUUID(device)
+	if err != nil {
+		return err
+	}
+	fsType, err := awsAsgEbs.fileSystemType(device)
+	if err != nil {
+		return err
+	}
+	options, err := awsAsgEbs.mountOptions(device)
+	if err != nil {
+		return err
+	}
+
+	path := awsAsgEbs.hostPath(fstabFile)
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entry := fstabEntry(uuid, mountPoint, fsType, options)
+	log.WithFields(log.Fields{"entry": entry}).Info("Adding mount to fstab")
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fstab")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(updateFstab(string(content), entry, uuid, mountPoint))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
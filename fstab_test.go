@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFstabEntry(t *testing.T) {
+	assert.Equal(t, "UUID=1234 /mnt/data ext4 defaults,nofail 0 2", fstabEntry("1234", "/mnt/data", "ext4", nil))
+	assert.Equal(t, "UUID=1234 /mnt/data xfs defaults,ro,nofail 0 2", fstabEntry("1234", "/mnt/data", "xfs", []string{"ro"}))
+}
+
+func TestUpdateFstab(t *testing.T) {
+	root := "LABEL=cloudimg-rootfs / ext4 defaults 0 1\n"
+	entry := "UUID=1234 /mnt/data ext4 defaults,nofail 0 2"
+
+	assert.Equal(t, entry+"\n", updateFstab("", entry, "1234", "/mnt/data"))
+	assert.Equal(t, root+entry+"\n", updateFstab(root, entry, "1234", "/mnt/data"))
+	assert.Equal(t, root+entry+"\n", updateFstab(root+"UUID=1234 /mnt/old ext4 defaults 0 2\n", entry, "1234", "/mnt/data"))
+	assert.Equal(t, root+entry+"\n", updateFstab(root+"UUID=5678 /mnt/data ext4 defaults 0 2\nUUID=1234 /mnt/old ext4 defaults 0 2\n", entry, "1234", "/mnt/data"))
+	assert.Equal(t, "# /mnt/data\n"+entry+"\n", updateFstab("# /mnt/data\n", entry, "1234", "/mnt/data"))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// imdsTokenTTL is the lifetime requested for IMDSv2 session tokens.
+const imdsTokenTTL = 6 * time.Hour
+
+// imdsToken fetches and caches the IMDSv2 session token. Instances that
+// require IMDSv2 reject metadata requests without it.
+type imdsToken struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *imdsToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequest("PUT", t.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(imdsTokenTTL.Seconds())))
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IMDSv2 token request failed: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	t.token = string(body)
+	// Renew early so a token never expires during a request.
+	t.expires = time.Now().Add(imdsTokenTTL - time.Minute)
+	return t.token, nil
+}
+
+// sign is a Build handler adding the session token to metadata requests.
+func (t *imdsToken) sign(r *request.Request) {
+	token, err := t.get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+	r.HTTPRequest.Header.Set("X-aws-ec2-metadata-token", token)
+}
+
+// newMetadataClient returns a metadata client that uses IMDSv2.
+func newMetadataClient() *ec2metadata.EC2Metadata {
+	metadata := ec2metadata.New(session.New())
+	token := &imdsToken{
+		url:    metadata.ClientInfo.Endpoint + "/api/token",
+		client: metadata.Config.HTTPClient,
+	}
+	metadata.Handlers.Build.PushBack(token.sign)
+	return metadata
+}
+
+// metadataRetryDelay is the pause between attempts of getMetadataWithRetry.
+var metadataRetryDelay = time.Second
+
+// getMetadataWithRetry retries fetch up to retries times. The metadata
+// service can be unavailable for a moment early during boot.
+func getMetadataWithRetry(retries int, fetch func() (string, error)) (string, error) {
+	value, err := fetch()
+	for i := 1; err != nil && i <= retries; i++ {
+		log.WithFields(log.Fields{"error": err, "attempt": i, "retries": retries}).Warn("Instance metadata not available, retrying")
+		time.Sleep(metadataRetryDelay)
+		value, err = fetch()
+	}
+	return value, err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImdsTokenIsCached(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "21600", r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+		w.Write([]byte("token-1"))
+	}))
+	defer server.Close()
+	token := &imdsToken{url: server.URL, client: server.Client()}
+
+	for i := 0; i < 2; i++ {
+		value, err := token.get()
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", value)
+	}
+	assert.Equal(t, 1, requests)
+}
+
+func TestImdsTokenRequestFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	token := &imdsToken{url: server.URL, client: server.Client()}
+
+	_, err := token.get()
+	assert.Error(t, err)
+}
+
+func TestGetMetadataWithRetry(t *testing.T) {
+	defer func(delay time.Duration) { metadataRetryDelay = delay }(metadataRetryDelay)
+	metadataRetryDelay = 0
+
+	attempts := 0
+	fetch := func() (string, error) {
+		attempts++
+		if attempts < 3 {
+			return "", errors.New("connection refused")
+		}
+		return "i-123456", nil
+	}
+
+	value, err := getMetadataWithRetry(2, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "i-123456", value)
+
+	attempts = 0
+	_, err = getMetadataWithRetry(1, fetch)
+	assert.Error(t, err)
+}
+
+func TestMetadataOrOverride(t *testing.T) {
+	fetch := func() (string, error) {
+		return "", errors.New("no instance metadata")
+	}
+
+	value, err := metadataOrOverride("eu-central-1", 0, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-central-1", value)
+
+	_, err = metadataOrOverride("", 0, fetch)
+	assert.Error(t, err)
+}
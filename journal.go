@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHook sends log entries to the systemd journal using its native
+// protocol, with the entry's fields as journal fields.
+type journalHook struct {
+	conn *net.UnixConn
+}
+
+func newJournalHook() (*journalHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHook{conn: conn}, nil
+}
+
+func (hook *journalHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+}
+
+func (hook *journalHook) Fire(entry *log.Entry) error {
+	_, err := hook.conn.Write(journalMessage(entry))
+	return err
+}
+
+var journalPriorities = map[log.Level]int{
+	log.PanicLevel: 2,
+	log.FatalLevel: 2,
+	log.ErrorLevel: 3,
+	log.WarnLevel:  4,
+	log.InfoLevel:  6,
+	log.DebugLevel: 7,
+}
+
+func journalMessage(entry *log.Entry) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	// Log messages are constant, so a hash of the message makes a stable
+	// MESSAGE_ID to filter on with journalctl.
+	writeJournalField(&b, "MESSAGE_ID", fmt.Sprintf("%x", md5.Sum([]byte(entry.Message))))
+	writeJournalField(&b, "PRIORITY", fmt.Sprintf("%d", journalPriorities[entry.Level]))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "asg-ebs")
+	for k, v := range entry.Data {
+		writeJournalField(&b, journalFieldName(k), fmt.Sprint(v))
+	}
+	return b.Bytes()
+}
+
+// journalFieldName converts a log field name to a valid journal field
+// name: upper case letters, digits and underscores, not starting with an
+// underscore.
+func journalFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return strings.TrimLeft(name, "_")
+}
+
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	// Values containing newlines are sent length-prefixed.
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
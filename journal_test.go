@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalMessage(t *testing.T) {
+	entry := log.WithFields(log.Fields{"volume": "vol-123456", "mount_point": "/mnt"})
+	entry.Message = "Mounting volume"
+	entry.Level = log.InfoLevel
+
+	message := string(journalMessage(entry))
+
+	assert.True(t, strings.HasPrefix(message, "MESSAGE=Mounting volume\nMESSAGE_ID="))
+	assert.Contains(t, message, "\nPRIORITY=6\n")
+	assert.Contains(t, message, "\nVOLUME=vol-123456\n")
+	assert.Contains(t, message, "\nMOUNT_POINT=/mnt\n")
+}
+
+func TestJournalMessageWithNewline(t *testing.T) {
+	entry := log.WithFields(log.Fields{"out": "a\nb"})
+	entry.Message = "Error running command"
+	entry.Level = log.ErrorLevel
+
+	message := string(journalMessage(entry))
+
+	assert.Contains(t, message, "\nOUT\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")
+}
+
+func TestJournalFieldName(t *testing.T) {
+	assert.Equal(t, "MOUNT_POINT", journalFieldName("mount_point"))
+	assert.Equal(t, "ERR", journalFieldName("_err"))
+	assert.Equal(t, "INSTANCE_ID", journalFieldName("instance-id"))
+}
@@ -1,125 +1,347 @@
 package main // import "github.com/Jimdo/asg-ebs"
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-type createFileSystemOnVolumeTimeout struct{}
-
-func (e createFileSystemOnVolumeTimeout) Error() string {
-	return "Volume Timeout"
-}
-
 type ByStartTime []*ec2.Snapshot
 
 func (s ByStartTime) Len() int           { return len(s) }
 func (s ByStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ByStartTime) Less(i, j int) bool { return (*s[i].StartTime).Before(*s[j].StartTime) }
 
-func waitForFile(file string, timeout time.Duration) error {
-	startTime := time.Now()
-	if _, err := os.Stat(file); err == nil {
-		return nil
+type ByCreateTime []*ec2.Volume
+
+func (v ByCreateTime) Len() int           { return len(v) }
+func (v ByCreateTime) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v ByCreateTime) Less(i, j int) bool { return (*v[i].CreateTime).Before(*v[j].CreateTime) }
+
+func waitForFile(file string, timeout time.Duration, pollInterval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(file); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("File " + file + " not found")
+		}
+		time.Sleep(pollInterval)
 	}
-	newTimeout := timeout - time.Since(startTime)
-	if newTimeout > 0 {
-		return waitForFile(file, newTimeout)
-	} else {
-		return errors.New("File " + file + " not found")
+}
+
+// waitForSentinel blocks until file exists and removes it again, so the
+// next run pauses as well. It gives up after timeout.
+func waitForSentinel(file string, pollInterval time.Duration, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(file); err == nil {
+			os.Remove(file)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("continue file %s was not created within %s", file, timeout)
+		}
+		time.Sleep(pollInterval)
 	}
 }
 
 func run(cmd string, args ...string) error {
+	return runWithTimeout(0, cmd, args...)
+}
+
+// runWithTimeout kills the command once it ran for timeout, 0 for no limit.
+func runWithTimeout(timeout time.Duration, cmd string, args ...string) error {
+	_, _, err := runCapture(timeout, cmd, args...)
+	return err
+}
+
+// runCapture runs the command like runWithTimeout and returns its stdout and
+// stderr separately, so that callers can parse stdout.
+func runCapture(timeout time.Duration, cmd string, args ...string) (string, string, error) {
 	log.WithFields(log.Fields{"cmd": cmd, "args": args}).Info("Running command")
-	out, err := exec.Command(cmd, args...).CombinedOutput()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, cmd, args...)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	err := command.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s did not finish within %s", cmd, timeout)
+	}
 	if err != nil {
-		log.WithFields(log.Fields{"cmd": cmd, "args": args, "err": err, "out": string(out)}).Info("Error running command")
-		return err
+		log.WithFields(log.Fields{"cmd": cmd, "args": args, "err": err, "stdout": stdout.String(), "stderr": stderr.String()}).Info("Error running command")
 	}
-	return nil
+	return stdout.String(), stderr.String(), err
 }
 
-func slurpFile(file string) string {
-	v, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err, "file": file}).Info("Failed to read file")
-	}
-	return string(v)
+// CommandRunner runs the external commands of AwsAsgEbs, so tests can
+// record them instead.
+type CommandRunner interface {
+	Run(cmd string, args ...string) error
+	// RunWithTimeout kills the command once it ran for timeout, 0 for no
+	// limit.
+	RunWithTimeout(timeout time.Duration, cmd string, args ...string) error
+	// Capture runs the command and returns its stdout for parsing.
+	Capture(cmd string, args ...string) (string, error)
+}
+
+// execRunner runs and logs commands with run, runWithTimeout and
+// runCapture.
+type execRunner struct{}
+
+func (execRunner) Run(cmd string, args ...string) error {
+	return run(cmd, args...)
+}
+
+func (execRunner) RunWithTimeout(timeout time.Duration, cmd string, args ...string) error {
+	return runWithTimeout(timeout, cmd, args...)
+}
+
+func (execRunner) Capture(cmd string, args ...string) (string, error) {
+	stdout, _, err := runCapture(0, cmd, args...)
+	return stdout, err
 }
 
 type AsgEbs interface {
 	checkDevice(device string) error
+	rootDevice() (string, error)
 	checkMountPoint(mountPoint string) error
+	lookupMount(mountPoint string) (*mountInfo, error)
 	findVolume(tagKey string, tagValue string) (*string, error)
 	attachVolume(volumeId string, attachAs string, deleteOnTermination bool) error
+	attachedVolume(attachAs string) (volumeId *string, isRoot bool, err error)
+	deviceMounts(device string) ([]mountInfo, error)
+	unmountDevice(device string) error
+	unmount(mountPoint string) error
+	detachVolume(volumeId string) error
+	setDeleteOnTermination(volumeId string, attachAs string, deleteOnTermination bool) error
+	availabilityZone() string
+	volumeAvailabilityZone(volumeId string) (string, error)
 	findSnapshot(tagKey string, tagValue string) (*string, error)
+	createSnapshot(volumeId string, description string, tags map[string]string) (*string, error)
+	waitUntilSnapshotCompleted(snapshotId string) error
+	deleteSnapshot(snapshotId string) error
+	ensureTags(volumeId string, tags map[string]string) error
+	volumeTags(volumeId string) (map[string]string, error)
+	setReadinessTag(volumeId string, key string, value string) error
+	checkMounted(mountPoint string, writable bool) error
+	deleteTag(volumeId string, key string) error
+	attachedVolumesSize() (int64, error)
 	createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error)
+	devicePath(volumeId string, attachAs string) string
+	attachedDevice(attachAs string) (string, error)
 	mountVolume(device string, mountPoint string) error
-	makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error
+	bindMount(source string, mountPoint string) error
+	overlayMount(lowerDir string, volumeMountPoint string, mountPoint string) error
+	persistMount(device string, mountPoint string) error
+	installMountUnit(device string, mountPoint string) error
+	fileSystemUsage(mountPoint string) (fileSystemUsage, error)
+	makeFileSystem(device string, mkfs mkfsConfig, volumeId string) error
+	setFileSystemUUID(device string, fsType string, uuid string) error
+	hasFileSystem(device string) (bool, error)
 	waitUntilVolumeAvailable(volumeId string) error
+	waitUntilVolumeInUse(volumeId string) error
+	growFileSystem(device string, mountPoint string) error
+	findAttachedVolume(tagKey string, tagValue string) (*ec2.Volume, error)
+	modifyVolumeSize(volumeId string, size int64) error
+	waitUntilVolumeModified(volumeId string, timeout time.Duration) error
+	setupThinPool(device string, volumeId string, create bool, virtualSize int64) (string, error)
+	findClusterVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error)
+	deleteVolume(volumeId string) error
+	waitUntilFileSystemCreated(volumeId string, timeout time.Duration) error
+	deactivateThinPool(volumeGroup string) error
+	checkCredentials(volumeId string) error
+	openVerity(device string, volumeId string, rootHash string, hashOffset int64) (string, error)
+	closeVerity(volumeId string) error
 }
 
 type AwsAsgEbs struct {
-	AwsConfig        *aws.Config
+	AwsConfig *aws.Config
+	Metadata  *ec2metadata.EC2Metadata
+	EC2       ec2API
+	// Runner runs external commands, execRunner when nil.
+	Runner             CommandRunner
+	Region             string
+	AvailabilityZone   string
+	InstanceId         string
+	AffinityTagKey     string
+	AffinityTagValue   string
+	DevicePollInterval time.Duration
+	RefreshInstanceId  bool
+	UseById            bool
+	LogCandidates      bool
+	ForceMountPoint    bool
+	ForceFormat        bool
+	ReadOnly           bool
+	// RequireFilesystemTag only reuses volumes tagged filesystem=true.
+	// Without it, volumes asg-ebs never formatted are reused as well.
+	RequireFilesystemTag bool
+	RateLimiter          *rateLimiter
+	LogRetries           bool
+	// OperationRetries take precedence over the MaxRetries of AwsConfig.
+	OperationRetries operationRetries
+	// TagOverwriteProtection only adds tags the resource does not have yet.
+	TagOverwriteProtection bool
+	// PreferSourceAz makes findSnapshot prefer snapshots tagged with the
+	// availability zone of the instance as source-az.
+	PreferSourceAz bool
+	// MountProfile selects curated mount options, see mountProfiles.
+	MountProfile string
+	// MountRetries is how often a failed mount is retried.
+	MountRetries int
+	// FilesystemMarkerTag is the key of the tag marking formatted
+	// volumes, "filesystem" when empty.
+	FilesystemMarkerTag string
+	// SnapshotOwner restricts findSnapshot to snapshots owned by this
+	// account id, or by "self".
+	SnapshotOwner string
+	// MountNamespacePid mounts in the mount namespace of this process
+	// instead of our own when set.
+	MountNamespacePid int
+	// BestFitSize picks the smallest volume of at least this size instead
+	// of the first one found when set.
+	BestFitSize int64
+	// VolumeOrder is the order findVolume considers matching volumes in,
+	// see sortVolumes.
+	VolumeOrder string
+	// MaxSnapshotSize skips snapshots of larger volumes in findSnapshot,
+	// as a volume cannot be smaller than its snapshot.
+	MaxSnapshotSize int64
+	// InheritSnapshotTags copies the tags of the snapshot a volume is
+	// created from to the volume.
+	InheritSnapshotTags bool
+	// Encrypted creates encrypted volumes, with KmsKeyId if set.
+	Encrypted bool
+	KmsKeyId  string
+	// CreateIops and CreateThroughput are the provisioned performance of
+	// created volumes, the AWS default for the volume type when zero.
+	CreateIops       int64
+	CreateThroughput int64
+	// VolumeInitializationRate in MiB/s pre-warms volumes created from a
+	// snapshot, the default lazy loading when zero.
+	VolumeInitializationRate int64
+	// MultiAttach creates volumes that several instances can attach, see
+	// attachClusterVolume.
+	MultiAttach bool
+	// Nitro instances expose volumes as NVMe devices, see expectedDevice.
+	Nitro bool
+	// AttachTimeout bounds the wait for the attachment to this instance,
+	// 10 minutes when zero.
+	AttachTimeout time.Duration
+}
+
+// awsEnvironment overrides what NewAwsAsgEbs otherwise takes from the
+// instance metadata, e.g. to run against localstack outside of EC2.
+type awsEnvironment struct {
+	Endpoint         string
 	Region           string
 	AvailabilityZone string
 	InstanceId       string
 }
 
-func NewAwsAsgEbs(maxRetries int) *AwsAsgEbs {
+// metadataOrOverride returns override if set and otherwise fetches the
+// value from the instance metadata.
+func metadataOrOverride(override string, retries int, fetch func() (string, error)) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	return getMetadataWithRetry(retries, fetch)
+}
+
+func NewAwsAsgEbs(maxRetries int, metadataRetries int, env awsEnvironment) (*AwsAsgEbs, error) {
 	awsAsgEbs := &AwsAsgEbs{}
 
-	metadata := ec2metadata.New(session.New())
+	metadata := newMetadataClient()
+	awsAsgEbs.Metadata = metadata
 
-	region, err := metadata.Region()
+	region, err := metadataOrOverride(env.Region, metadataRetries, metadata.Region)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Failed to get region from instance metadata")
+		return nil, wrapError(ErrMetadataFailed, fmt.Errorf("region: %w", err))
 	}
 	log.WithFields(log.Fields{"region": region}).Info("Setting region")
 	awsAsgEbs.Region = region
 
-	availabilityZone, err := metadata.GetMetadata("placement/availability-zone")
+	availabilityZone, err := metadataOrOverride(env.AvailabilityZone, metadataRetries, func() (string, error) {
+		return metadata.GetMetadata("placement/availability-zone")
+	})
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Failed to get availability zone from instance metadata")
+		return nil, wrapError(ErrMetadataFailed, fmt.Errorf("availability zone: %w", err))
 	}
 	log.WithFields(log.Fields{"az": availabilityZone}).Info("Setting availability zone")
 	awsAsgEbs.AvailabilityZone = availabilityZone
 
-	instanceId, err := metadata.GetMetadata("instance-id")
+	instanceId, err := metadataOrOverride(env.InstanceId, metadataRetries, func() (string, error) {
+		return metadata.GetMetadata("instance-id")
+	})
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Failed to get instance id from instance metadata")
+		return nil, wrapError(ErrMetadataFailed, fmt.Errorf("instance id: %w", err))
 	}
 	log.WithFields(log.Fields{"instance_id": instanceId}).Info("Setting instance id")
 	awsAsgEbs.InstanceId = instanceId
 
+	awsAsgEbs.Nitro = isNitro()
+	log.WithFields(log.Fields{"nitro": awsAsgEbs.Nitro}).Info("Detected instance family")
+
 	awsAsgEbs.AwsConfig = aws.NewConfig().
 		WithRegion(region).
-		WithCredentials(ec2rolecreds.NewCredentials(session.New())).
+		WithCredentials(ec2rolecreds.NewCredentialsWithClient(metadata)).
 		WithMaxRetries(maxRetries)
+	if env.Endpoint != "" {
+		log.WithFields(log.Fields{"endpoint": env.Endpoint}).Info("Using custom EC2 endpoint")
+		// Outside of EC2 there is no instance role, so the credentials come
+		// from the environment or the shared credentials file first.
+		awsAsgEbs.AwsConfig = awsAsgEbs.AwsConfig.
+			WithEndpoint(env.Endpoint).
+			WithCredentials(credentials.NewChainCredentials([]credentials.Provider{
+				&credentials.EnvProvider{},
+				&credentials.SharedCredentialsProvider{},
+				&ec2rolecreds.EC2RoleProvider{Client: metadata},
+			}))
+	}
 
-	return awsAsgEbs
+	return awsAsgEbs, nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string, error) {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+func (awsAsgEbs *AwsAsgEbs) filesystemTag() string {
+	if awsAsgEbs.FilesystemMarkerTag == "" {
+		return "filesystem"
+	}
+	return awsAsgEbs.FilesystemMarkerTag
+}
 
+func (awsAsgEbs *AwsAsgEbs) findVolumeInput(tagKey string, tagValue string) *ec2.DescribeVolumesInput {
 	params := &ec2.DescribeVolumesInput{
 		Filters: []*ec2.Filter{
 			{
@@ -128,12 +350,6 @@ func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string,
 					aws.String(tagValue),
 				},
 			},
-			{
-				Name: aws.String("tag:filesystem"),
-				Values: []*string{
-					aws.String("true"),
-				},
-			},
 			{
 				Name: aws.String("status"),
 				Values: []*string{
@@ -148,21 +364,170 @@ func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string,
 			},
 		},
 	}
+	if awsAsgEbs.RequireFilesystemTag {
+		params.Filters = append(params.Filters, &ec2.Filter{
+			Name: aws.String("tag:" + awsAsgEbs.filesystemTag()),
+			Values: []*string{
+				aws.String("true"),
+			},
+		})
+	}
+	return params
+}
+
+func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string, error) {
+	svc := awsAsgEbs.ec2Client()
 
-	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	volumes := []*ec2.Volume{}
+	err := svc.DescribeVolumesPages(awsAsgEbs.findVolumeInput(tagKey, tagValue), func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		volumes = append(volumes, page.Volumes...)
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(describeVolumesOutput.Volumes) == 0 {
+	if awsAsgEbs.AffinityTagKey != "" {
+		volumes = filterByAffinity(volumes, awsAsgEbs.AffinityTagKey, awsAsgEbs.AffinityTagValue)
+	}
+	sortVolumes(volumes, awsAsgEbs.VolumeOrder)
+	log.WithFields(log.Fields{"count": len(volumes), "tag_key": tagKey, "tag_value": tagValue}).Info("Found matching volumes")
+	if awsAsgEbs.LogCandidates {
+		logCandidates(volumes)
+	}
+	if awsAsgEbs.BestFitSize > 0 {
+		volume := selectBestFit(volumes, awsAsgEbs.BestFitSize)
+		if volume == nil {
+			log.WithFields(log.Fields{"candidates": len(volumes), "size": awsAsgEbs.BestFitSize}).Info("No volume is large enough")
+			return nil, nil
+		}
+		log.WithFields(log.Fields{"volume": aws.StringValue(volume.VolumeId), "volume_size": aws.Int64Value(volume.Size), "size": awsAsgEbs.BestFitSize, "candidates": len(volumes)}).Info("Selected smallest volume of at least the size")
+		return volume.VolumeId, nil
+	}
+	if len(volumes) == 0 {
 		return nil, nil
 	}
-	return describeVolumesOutput.Volumes[0].VolumeId, nil
+	return volumes[0].VolumeId, nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*string, error) {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+// sortVolumes sorts volumes by creation time, "oldest" or "newest" first,
+// so all instances prefer the same volume. Any other order keeps the order
+// EC2 returned them in.
+func sortVolumes(volumes []*ec2.Volume, order string) {
+	switch order {
+	case "oldest":
+		sort.Stable(ByCreateTime(volumes))
+	case "newest":
+		sort.Stable(sort.Reverse(ByCreateTime(volumes)))
+	}
+}
 
-	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
+// selectBestFit returns the smallest volume of at least size, the first
+// found of those on a tie.
+func selectBestFit(volumes []*ec2.Volume, size int64) *ec2.Volume {
+	var best *ec2.Volume
+	for _, volume := range volumes {
+		volumeSize := aws.Int64Value(volume.Size)
+		if volumeSize < size {
+			continue
+		}
+		if best == nil || volumeSize < aws.Int64Value(best.Size) {
+			best = volume
+		}
+	}
+	return best
+}
+
+func (awsAsgEbs *AwsAsgEbs) describeInstanceTag(tagKey string) (*string, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeTagsInput := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("resource-id"),
+				Values: []*string{
+					aws.String(awsAsgEbs.InstanceId),
+				},
+			},
+			{
+				Name: aws.String("key"),
+				Values: []*string{
+					aws.String(tagKey),
+				},
+			},
+		},
+	}
+	describeTagsOutput, err := svc.DescribeTags(describeTagsInput)
+	if err != nil {
+		return nil, err
+	}
+	if len(describeTagsOutput.Tags) == 0 {
+		return nil, nil
+	}
+	return describeTagsOutput.Tags[0].Value, nil
+}
+
+type volumeCandidate struct {
+	VolumeId   string            `json:"volume_id"`
+	Size       int64             `json:"size"`
+	CreateTime time.Time         `json:"create_time"`
+	Tags       map[string]string `json:"tags"`
+}
+
+func candidatesJSON(volumes []*ec2.Volume) string {
+	candidates := []volumeCandidate{}
+	for _, volume := range volumes {
+		candidate := volumeCandidate{
+			VolumeId:   aws.StringValue(volume.VolumeId),
+			Size:       aws.Int64Value(volume.Size),
+			CreateTime: aws.TimeValue(volume.CreateTime),
+			Tags:       map[string]string{},
+		}
+		for _, tag := range volume.Tags {
+			candidate.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		candidates = append(candidates, candidate)
+	}
+	out, _ := json.Marshal(candidates)
+	return string(out)
+}
+
+func logCandidates(volumes []*ec2.Volume) {
+	log.WithFields(log.Fields{"count": len(volumes), "candidates": candidatesJSON(volumes)}).Info("Candidate volumes")
+}
+
+func findTag(tags []*ec2.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+func filterByAffinity(volumes []*ec2.Volume, tagKey string, tagValue string) []*ec2.Volume {
+	matching := []*ec2.Volume{}
+	for _, volume := range volumes {
+		affinity, ok := findTag(volume.Tags, tagKey)
+		if !ok || affinity != tagValue {
+			log.WithFields(log.Fields{"volume": aws.StringValue(volume.VolumeId), "affinity_tag": tagKey, "expected": tagValue, "actual": affinity}).Info("Rejecting volume with mismatching affinity")
+			continue
+		}
+		matching = append(matching, volume)
+	}
+	return matching
+}
+
+var accountIdPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+func validateSnapshotOwner(owner string) error {
+	if owner != "self" && !accountIdPattern.MatchString(owner) {
+		return fmt.Errorf("invalid snapshot owner '%s', expected self or an account id", owner)
+	}
+	return nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) findSnapshotInput(tagKey string, tagValue string) *ec2.DescribeSnapshotsInput {
+	params := &ec2.DescribeSnapshotsInput{
 		Filters: []*ec2.Filter{
 			{
 				Name: aws.String("tag:" + tagKey),
@@ -178,7 +543,20 @@ func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*strin
 			},
 		},
 	}
-	describeSnapshotsOutput, err := svc.DescribeSnapshots(describeSnapshotsInput)
+	if awsAsgEbs.SnapshotOwner != "" {
+		params.OwnerIds = []*string{aws.String(awsAsgEbs.SnapshotOwner)}
+	}
+	return params
+}
+
+// errNoFittingSnapshot is returned by findSnapshot when snapshots with the
+// tag exist, but all of volumes larger than MaxSnapshotSize.
+var errNoFittingSnapshot = errors.New("no snapshot fits the volume size")
+
+func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*string, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeSnapshotsOutput, err := svc.DescribeSnapshots(awsAsgEbs.findSnapshotInput(tagKey, tagValue))
 	if err != nil {
 		return nil, err
 	}
@@ -189,11 +567,98 @@ func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*strin
 		return nil, nil
 	}
 
-	return snapshots[0].SnapshotId, nil
+	if awsAsgEbs.MaxSnapshotSize > 0 {
+		fitting := snapshotsFittingSize(snapshots, awsAsgEbs.MaxSnapshotSize)
+		if len(fitting) == 0 {
+			log.WithFields(log.Fields{"count": len(snapshots), "tag_key": tagKey, "tag_value": tagValue, "max_size": awsAsgEbs.MaxSnapshotSize}).Warn("All snapshots with tag are of volumes larger than the new volume")
+			return nil, fmt.Errorf("%w: all %d snapshots with tag %s=%s are of volumes larger than %d GiB", errNoFittingSnapshot, len(snapshots), tagKey, tagValue, awsAsgEbs.MaxSnapshotSize)
+		}
+		if len(fitting) < len(snapshots) {
+			log.WithFields(log.Fields{"skipped": len(snapshots) - len(fitting), "max_size": awsAsgEbs.MaxSnapshotSize}).Warn("Skipping snapshots of volumes larger than the new volume")
+		}
+		snapshots = fitting
+	}
+
+	snapshot := snapshots[0]
+	if awsAsgEbs.PreferSourceAz {
+		snapshot = selectSnapshotBySourceAz(snapshots, awsAsgEbs.AvailabilityZone)
+	}
+	log.WithFields(log.Fields{"snapshot": aws.StringValue(snapshot.SnapshotId), "volume_size": aws.Int64Value(snapshot.VolumeSize), "tag_key": tagKey, "tag_value": tagValue}).Info("Selected snapshot")
+	return snapshot.SnapshotId, nil
+}
+
+// snapshotsFittingSize returns the snapshots of volumes of at most size GiB,
+// keeping their order.
+func snapshotsFittingSize(snapshots []*ec2.Snapshot, size int64) []*ec2.Snapshot {
+	fitting := []*ec2.Snapshot{}
+	for _, snapshot := range snapshots {
+		if aws.Int64Value(snapshot.VolumeSize) <= size {
+			fitting = append(fitting, snapshot)
+		}
+	}
+	return fitting
+}
+
+// selectSnapshotBySourceAz returns the newest of the snapshots, sorted
+// newest first, tagged with source-az=az, or the newest overall if none is.
+func selectSnapshotBySourceAz(snapshots []*ec2.Snapshot, az string) *ec2.Snapshot {
+	for _, snapshot := range snapshots {
+		if sourceAz, ok := findTag(snapshot.Tags, "source-az"); ok && sourceAz == az {
+			log.WithFields(log.Fields{"snapshot": aws.StringValue(snapshot.SnapshotId), "source_az": sourceAz}).Info("Selected newest snapshot from this availability zone")
+			return snapshot
+		}
+	}
+	log.WithFields(log.Fields{"snapshot": aws.StringValue(snapshots[0].SnapshotId), "availability_zone": az}).Info("No snapshot from this availability zone, selected newest snapshot")
+	return snapshots[0]
+}
+
+func (awsAsgEbs *AwsAsgEbs) createSnapshot(volumeId string, description string, tags map[string]string) (*string, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	createSnapshotInput := &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volumeId),
+		Description: aws.String(description),
+	}
+	snapshot, err := svc.CreateSnapshot(createSnapshotInput)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeTags, err := describeResourceTags(svc, volumeId)
+	if err != nil {
+		return snapshot.SnapshotId, err
+	}
+	tags = withVolumeTags(tags, volumeTags, []string{awsAsgEbs.filesystemTag(), "filesystem-type"})
+
+	err = awsAsgEbs.createTags(svc, *snapshot.SnapshotId, toEc2Tags(tags))
+	if err != nil {
+		return snapshot.SnapshotId, err
+	}
+
+	return snapshot.SnapshotId, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) waitUntilSnapshotCompleted(snapshotId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotId)},
+	}
+	return svc.WaitUntilSnapshotCompleted(describeSnapshotsInput)
+}
+
+func (awsAsgEbs *AwsAsgEbs) deleteSnapshot(snapshotId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	deleteSnapshotInput := &ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(snapshotId),
+	}
+	_, err := svc.DeleteSnapshot(deleteSnapshotInput)
+	return err
 }
 
 func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error) {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+	svc := awsAsgEbs.ec2Client()
 
 	filesystem := "false"
 
@@ -208,7 +673,35 @@ func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, cr
 		filesystem = "true"
 	}
 
-	vol, err := svc.CreateVolume(createVolumeInput)
+	// The snapshot tags are read before the volume exists, so failing to
+	// read them does not leave an untagged volume behind.
+	if snapshotId != nil && awsAsgEbs.InheritSnapshotTags {
+		snapshotTags, err := describeSnapshotTags(svc, *snapshotId)
+		if err != nil {
+			return nil, err
+		}
+		createTags = withSnapshotTags(createTags, snapshotTags, []string{"Name", awsAsgEbs.filesystemTag()})
+	}
+
+	// Without KmsKeyId, EBS uses the key of an encrypted snapshot or the
+	// account's default key.
+	if awsAsgEbs.Encrypted {
+		createVolumeInput.Encrypted = aws.Bool(true)
+		if awsAsgEbs.KmsKeyId != "" {
+			createVolumeInput.KmsKeyId = aws.String(awsAsgEbs.KmsKeyId)
+		}
+	}
+
+	// A capacity fallback volume type may not support the options.
+	if awsAsgEbs.CreateIops != 0 && supportsIops(createVolumeType) {
+		createVolumeInput.Iops = aws.Int64(awsAsgEbs.CreateIops)
+	}
+	req, vol := svc.CreateVolumeRequest(createVolumeInput)
+	awsAsgEbs.addCreateVolumeParameters(req, createVolumeType, snapshotId != nil)
+	err := req.Send()
+	if err != nil && awsAsgEbs.Encrypted && awsAsgEbs.KmsKeyId == "" && isKmsError(err) {
+		return nil, fmt.Errorf("encrypting with the default EBS key of the account failed, set --kms-key-id: %w", err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -218,46 +711,203 @@ func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, cr
 			Value: aws.String(createName),
 		},
 		{
-			Key:   aws.String("filesystem"),
+			Key:   aws.String(awsAsgEbs.filesystemTag()),
 			Value: aws.String(filesystem),
 		},
 	}
-	for k, v := range createTags {
-		tags = append(tags,
-			&ec2.Tag{
-				Key:   aws.String(k),
-				Value: aws.String(v),
+	tags = append(tags, toEc2Tags(createTags)...)
+
+	err = awsAsgEbs.createTags(svc, *vol.VolumeId, tags)
+	if err != nil {
+		return vol.VolumeId, err
+	}
+
+	return vol.VolumeId, nil
+}
+
+// attachedVolumesSize returns the total size in GiB of all volumes attached
+// to the instance, including the root volume.
+func (awsAsgEbs *AwsAsgEbs) attachedVolumesSize() (int64, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("attachment.instance-id"),
+				Values: []*string{
+					aws.String(awsAsgEbs.InstanceId),
+				},
 			},
-		)
+		},
 	}
+	var size int64
+	err := svc.DescribeVolumesPages(describeVolumesInput, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		for _, volume := range page.Volumes {
+			size += aws.Int64Value(volume.Size)
+		}
+		return true
+	})
+	return size, err
+}
+
+// setReadinessTag tags the volume once it is mounted. Like filesystem, the
+// tag is owned by asg-ebs and bypasses the tag overwrite protection.
+func (awsAsgEbs *AwsAsgEbs) setReadinessTag(volumeId string, key string, value string) error {
+	svc := awsAsgEbs.ec2Client()
 
 	createTagsInput := &ec2.CreateTagsInput{
-		Resources: []*string{vol.VolumeId},
-		Tags:      tags,
+		Resources: []*string{aws.String(volumeId)},
+		Tags:      toEc2Tags(map[string]string{key: value}),
 	}
-	_, err = svc.CreateTags(createTagsInput)
-	if err != nil {
-		return vol.VolumeId, err
+	_, err := svc.CreateTags(createTagsInput)
+	return err
+}
+
+func (awsAsgEbs *AwsAsgEbs) deleteTag(volumeId string, key string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	deleteTagsInput := &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(volumeId)},
+		Tags:      []*ec2.Tag{{Key: aws.String(key)}},
 	}
+	_, err := svc.DeleteTags(deleteTagsInput)
+	return err
+}
 
-	return vol.VolumeId, nil
+func (awsAsgEbs *AwsAsgEbs) volumeTags(volumeId string) (map[string]string, error) {
+	svc := awsAsgEbs.ec2Client()
+	return describeResourceTags(svc, volumeId)
+}
+
+func (awsAsgEbs *AwsAsgEbs) ensureTags(volumeId string, tags map[string]string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	existing, err := describeResourceTags(svc, volumeId)
+	if err != nil {
+		return err
+	}
+	changed := changedTags(tags, existing)
+	if len(changed) == 0 {
+		log.WithFields(log.Fields{"volume": volumeId}).Info("Volume tags are up to date")
+		return nil
+	}
+	for _, tag := range changed {
+		key := aws.StringValue(tag.Key)
+		old, ok := existing[key]
+		if !ok {
+			old = "<unset>"
+		}
+		log.WithFields(log.Fields{"volume": volumeId, "key": key, "old": old, "new": aws.StringValue(tag.Value)}).Info("Reconciling volume tag")
+	}
+	return awsAsgEbs.createTags(svc, volumeId, changed)
 }
 
 func (awsAsgEbs *AwsAsgEbs) waitUntilVolumeAvailable(volumeId string) error {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+	svc := awsAsgEbs.ec2Client()
 
 	describeVolumeInput := &ec2.DescribeVolumesInput{
 		VolumeIds: []*string{aws.String(volumeId)},
 	}
-	err := svc.WaitUntilVolumeAvailable(describeVolumeInput)
+	return svc.WaitUntilVolumeAvailable(describeVolumeInput)
+}
+
+func (awsAsgEbs *AwsAsgEbs) availabilityZone() string {
+	return awsAsgEbs.AvailabilityZone
+}
+
+func (awsAsgEbs *AwsAsgEbs) volumeAvailabilityZone(volumeId string) (string, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	}
+	describeVolumesOutput, err := svc.DescribeVolumes(describeVolumesInput)
+	if err != nil {
+		return "", err
+	}
+	if len(describeVolumesOutput.Volumes) == 0 {
+		return "", fmt.Errorf("volume %s not found", volumeId)
+	}
+	return aws.StringValue(describeVolumesOutput.Volumes[0].AvailabilityZone), nil
+}
+
+// newSession returns a session for AWS service clients with the request
+// handlers shared by all calls.
+func (awsAsgEbs *AwsAsgEbs) newSession() *session.Session {
+	sess := session.New(awsAsgEbs.AwsConfig)
+	if awsAsgEbs.RateLimiter != nil {
+		sess.Handlers.Send.PushFront(awsAsgEbs.RateLimiter.wait)
+	}
+	if awsAsgEbs.LogRetries {
+		sess.Handlers.AfterRetry.PushFront(logRetry)
+	}
+	if len(awsAsgEbs.OperationRetries) > 0 {
+		sess.Handlers.Build.PushBack(awsAsgEbs.OperationRetries.apply)
+	}
+	return sess
+}
+
+// ec2API is the part of the EC2 client asg-ebs uses. The vendored
+// ec2iface.EC2API does not include the waiters yet, NewRequest is used for
+// the operations the vendored SDK does not know.
+type ec2API interface {
+	ec2iface.EC2API
+	NewRequest(operation *request.Operation, params interface{}, data interface{}) *request.Request
+	WaitUntilVolumeAvailable(*ec2.DescribeVolumesInput) error
+	WaitUntilVolumeInUse(*ec2.DescribeVolumesInput) error
+	WaitUntilSnapshotCompleted(*ec2.DescribeSnapshotsInput) error
+}
+
+// ec2Client returns the EC2 client shared by all methods. It is created on
+// first use, so it picks up the handlers configured after NewAwsAsgEbs.
+func (awsAsgEbs *AwsAsgEbs) ec2Client() ec2API {
+	if awsAsgEbs.EC2 == nil {
+		awsAsgEbs.EC2 = ec2.New(awsAsgEbs.newSession())
+	}
+	return awsAsgEbs.EC2
+}
+
+func (awsAsgEbs *AwsAsgEbs) commandRunner() CommandRunner {
+	if awsAsgEbs.Runner == nil {
+		return execRunner{}
+	}
+	return awsAsgEbs.Runner
+}
+
+// logRetry runs right before the SDK's own AfterRetry handler, which sleeps
+// and retries the request if it decides to.
+func logRetry(r *request.Request) {
+	if r.Retryable == nil {
+		r.Retryable = aws.Bool(r.ShouldRetry(r))
+	}
+	if r.WillRetry() {
+		log.WithFields(log.Fields{"operation": r.Operation.Name, "attempt": r.RetryCount + 1, "max_retries": r.MaxRetries(), "error": r.Error}).Warn("Retrying AWS request")
+	}
+}
+
+// refreshInstanceId re-reads the instance id from the instance metadata.
+// Instances launched from a warm pool can report a different id than at boot.
+func (awsAsgEbs *AwsAsgEbs) refreshInstanceId() error {
+	instanceId, err := awsAsgEbs.Metadata.GetMetadata("instance-id")
 	if err != nil {
-		return &createFileSystemOnVolumeTimeout{}
+		return err
+	}
+	if instanceId != awsAsgEbs.InstanceId {
+		log.WithFields(log.Fields{"instance_id": instanceId, "previous_instance_id": awsAsgEbs.InstanceId}).Info("Instance id changed")
+		awsAsgEbs.InstanceId = instanceId
 	}
 	return nil
 }
 
 func (awsAsgEbs *AwsAsgEbs) attachVolume(volumeId string, attachAs string, deleteOnTermination bool) error {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+	svc := awsAsgEbs.ec2Client()
+
+	if awsAsgEbs.RefreshInstanceId {
+		err := awsAsgEbs.refreshInstanceId()
+		if err != nil {
+			return err
+		}
+	}
 
 	attachVolumeInput := &ec2.AttachVolumeInput{
 		VolumeId:   aws.String(volumeId),
@@ -269,35 +919,19 @@ func (awsAsgEbs *AwsAsgEbs) attachVolume(volumeId string, attachAs string, delet
 		return err
 	}
 
-	describeVolumeInput := &ec2.DescribeVolumesInput{
-		VolumeIds: []*string{aws.String(volumeId)},
-	}
-	err = svc.WaitUntilVolumeInUse(describeVolumeInput)
+	err = awsAsgEbs.waitUntilAttached(svc, volumeId)
 	if err != nil {
 		return err
 	}
 
 	if deleteOnTermination {
-		modifyInstanceAttributeInput := &ec2.ModifyInstanceAttributeInput{
-			Attribute:  aws.String("blockDeviceMapping"),
-			InstanceId: aws.String(awsAsgEbs.InstanceId),
-			BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
-				{
-					DeviceName: aws.String(attachAs),
-					Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
-						DeleteOnTermination: aws.Bool(true),
-						VolumeId:            aws.String(volumeId),
-					},
-				},
-			},
-		}
-		_, err = svc.ModifyInstanceAttribute(modifyInstanceAttributeInput)
+		err = awsAsgEbs.setDeleteOnTermination(volumeId, attachAs, true)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = waitForFile("/dev/"+attachAs, 60*time.Second)
+	err = waitForFile(expectedDevice(volumeId, attachAs, awsAsgEbs.Nitro), 60*time.Second, awsAsgEbs.DevicePollInterval)
 	if err != nil {
 		return err
 	}
@@ -305,36 +939,265 @@ func (awsAsgEbs *AwsAsgEbs) attachVolume(volumeId string, attachAs string, delet
 	return nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error {
-	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+// attachedVolume returns the volume attached to this instance as attachAs
+// and whether it is the root volume.
+func (awsAsgEbs *AwsAsgEbs) attachedVolume(attachAs string) (*string, bool, error) {
+	svc := awsAsgEbs.ec2Client()
 
-	err := run("/usr/sbin/mkfs.ext4", "-i", fmt.Sprintf("%d", mkfsInodeRatio), device)
-	if err != nil {
-		return err
+	describeInstancesInput := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(awsAsgEbs.InstanceId)},
 	}
-	tags := []*ec2.Tag{
-		{
-			Key:   aws.String("filesystem"),
-			Value: aws.String("true"),
-		},
+	describeInstancesOutput, err := svc.DescribeInstances(describeInstancesInput)
+	if err != nil {
+		return nil, false, err
 	}
-	createTagsInput := &ec2.CreateTagsInput{
-		Resources: []*string{aws.String(volumeId)},
-		Tags:      tags,
+	for _, reservation := range describeInstancesOutput.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, mapping := range instance.BlockDeviceMappings {
+				if mapping.Ebs == nil || strings.TrimPrefix(aws.StringValue(mapping.DeviceName), "/dev/") != strings.TrimPrefix(attachAs, "/dev/") {
+					continue
+				}
+				isRoot := aws.StringValue(mapping.DeviceName) == aws.StringValue(instance.RootDeviceName)
+				return mapping.Ebs.VolumeId, isRoot, nil
+			}
+		}
 	}
-	_, err = svc.CreateTags(createTagsInput)
+	return nil, false, nil
+}
+
+// deviceMounts returns the mounts of device in the order they were made.
+func (awsAsgEbs *AwsAsgEbs) deviceMounts(device string) ([]mountInfo, error) {
+	mounts, err := readMountInfo(awsAsgEbs.mountInfoFile())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return findMountsOfDevice(mounts, device), nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) mountVolume(device string, mountPoint string) error {
-	err := os.MkdirAll(mountPoint, 0755)
+func (awsAsgEbs *AwsAsgEbs) unmountDevice(device string) error {
+	deviceMounts, err := awsAsgEbs.deviceMounts(device)
 	if err != nil {
 		return err
 	}
-	return run("/bin/mount", device, mountPoint)
+	for i := len(deviceMounts) - 1; i >= 0; i-- {
+		err = awsAsgEbs.runMount("/bin/umount", deviceMounts[i].MountPoint)
+		if err != nil {
+			return fmt.Errorf("unmounting %s: %w", deviceMounts[i].MountPoint, err)
+		}
+	}
+	return nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) unmount(mountPoint string) error {
+	return awsAsgEbs.runMount("/bin/umount", mountPoint)
+}
+
+// setDeleteOnTermination changes whether the volume attached as attachAs is
+// deleted when the instance terminates.
+func (awsAsgEbs *AwsAsgEbs) setDeleteOnTermination(volumeId string, attachAs string, deleteOnTermination bool) error {
+	svc := awsAsgEbs.ec2Client()
+
+	modifyInstanceAttributeInput := &ec2.ModifyInstanceAttributeInput{
+		Attribute:  aws.String("blockDeviceMapping"),
+		InstanceId: aws.String(awsAsgEbs.InstanceId),
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
+			{
+				DeviceName: aws.String(attachAs),
+				Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+					DeleteOnTermination: aws.Bool(deleteOnTermination),
+					VolumeId:            aws.String(volumeId),
+				},
+			},
+		},
+	}
+	_, err := svc.ModifyInstanceAttribute(modifyInstanceAttributeInput)
+	return err
+}
+
+func (awsAsgEbs *AwsAsgEbs) detachVolume(volumeId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	detachVolumeInput := &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeId),
+		InstanceId: aws.String(awsAsgEbs.InstanceId),
+	}
+	_, err := svc.DetachVolume(detachVolumeInput)
+	return err
+}
+
+func (awsAsgEbs *AwsAsgEbs) waitUntilVolumeInUse(volumeId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumeInput := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	}
+	return svc.WaitUntilVolumeInUse(describeVolumeInput)
+}
+
+func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, mkfs mkfsConfig, volumeId string) error {
+	svc := awsAsgEbs.ec2Client()
+
+	// A volume formatted out of band or one that lost its filesystem tag
+	// must not be formatted again, that would destroy its data.
+	fsType := mkfs.fsType
+	exists := false
+	var err error
+	if !awsAsgEbs.ForceFormat {
+		exists, err = awsAsgEbs.hasFileSystem(device)
+		if err != nil {
+			return err
+		}
+	}
+	if exists {
+		fsType, err = awsAsgEbs.fileSystemType(device)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"device": device, "fs_type": fsType}).Warn("Device already has a file system, not formatting it, use --force-format to format anyway")
+	} else {
+		cmd, args := mkfsCommand(device, mkfs)
+		err = awsAsgEbs.commandRunner().RunWithTimeout(mkfs.timeout, cmd, args...)
+		if err != nil {
+			return err
+		}
+	}
+	// The filesystem tags are owned by asg-ebs and filesystem has to flip
+	// from false to true here, so they bypass the tag overwrite protection.
+	tags := []*ec2.Tag{
+		{
+			Key:   aws.String(awsAsgEbs.filesystemTag()),
+			Value: aws.String("true"),
+		},
+		{
+			Key:   aws.String("filesystem-type"),
+			Value: aws.String(fsType),
+		},
+	}
+	createTagsInput := &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(volumeId)},
+		Tags:      tags,
+	}
+	_, err = svc.CreateTags(createTagsInput)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) setFileSystemUUID(device string, fsType string, uuid string) error {
+	cmd, args := setUUIDCommand(device, fsType, uuid)
+	return awsAsgEbs.commandRunner().Run(cmd, args...)
+}
+
+// prepareMountPoint creates the mount point directory. A file or broken
+// symlink in its place is an error, or is removed first with force.
+func prepareMountPoint(mountPoint string, force bool) error {
+	if _, err := os.Lstat(mountPoint); err == nil {
+		if info, err := os.Stat(mountPoint); err != nil || !info.IsDir() {
+			if !force {
+				return fmt.Errorf("mount point %s exists but is not a directory", mountPoint)
+			}
+			log.WithFields(log.Fields{"mount_point": mountPoint}).Warn("Removing file in place of mount point")
+			if err := os.Remove(mountPoint); err != nil {
+				return err
+			}
+		}
+	}
+	return os.MkdirAll(mountPoint, 0755)
+}
+
+// mountOptions returns the options mountVolume mounts device with.
+func (awsAsgEbs *AwsAsgEbs) mountOptions(device string) ([]string, error) {
+	options := []string{}
+	if awsAsgEbs.MountProfile != "" {
+		fsType, err := awsAsgEbs.fileSystemType(device)
+		if err != nil {
+			return nil, err
+		}
+		profileOptions, err := mountProfileOptions(awsAsgEbs.MountProfile, fsType)
+		if err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{"profile": awsAsgEbs.MountProfile, "fs_type": fsType, "options": profileOptions}).Info("Using mount profile")
+		options = append(options, profileOptions)
+	}
+	if awsAsgEbs.ReadOnly {
+		options = append(options, "ro")
+	}
+	return options, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) mountVolume(device string, mountPoint string) error {
+	err := prepareMountPoint(awsAsgEbs.hostPath(mountPoint), awsAsgEbs.ForceMountPoint)
+	if err != nil {
+		return err
+	}
+	args := []string{device, mountPoint}
+	options, err := awsAsgEbs.mountOptions(device)
+	if err != nil {
+		return err
+	}
+	if len(options) > 0 {
+		args = append([]string{"-o", strings.Join(options, ",")}, args...)
+	}
+	mount := func() error {
+		return awsAsgEbs.runMount("/bin/mount", args...)
+	}
+	isMounted := func() (bool, error) {
+		return awsAsgEbs.isMountedFrom(device, mountPoint)
+	}
+	err = mountWithRetry(mount, isMounted, awsAsgEbs.MountRetries)
+	if err != nil {
+		return err
+	}
+	// mount has been seen to exit 0 without the mount taking effect.
+	mounted, err := isMountPoint(awsAsgEbs.hostPath(mountPoint))
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("%s is not a mount point after mounting %s", mountPoint, device)
+	}
+	return nil
+}
+
+// mountRetryDelay is the pause between mount attempts.
+var mountRetryDelay = 2 * time.Second
+
+// mountWithRetry retries a failed mount up to retries times. A failed
+// attempt may still have mounted, so before each retry mounted is asked
+// and the mount counts as done if it is.
+func mountWithRetry(mount func() error, mounted func() (bool, error), retries int) error {
+	err := mount()
+	for i := 1; err != nil && i <= retries; i++ {
+		done, checkErr := mounted()
+		if checkErr == nil && done {
+			log.WithFields(log.Fields{"error": err}).Info("Mount reported an error but is in place")
+			return nil
+		}
+		log.WithFields(log.Fields{"error": err, "attempt": i}).Warn("Mount failed, retrying")
+		time.Sleep(mountRetryDelay)
+		err = mount()
+	}
+	return err
+}
+
+// isMountedFrom reports whether device is mounted exactly at mountPoint.
+func (awsAsgEbs *AwsAsgEbs) isMountedFrom(device string, mountPoint string) (bool, error) {
+	mounts, err := readMountInfo(awsAsgEbs.mountInfoFile())
+	if err != nil {
+		return false, err
+	}
+	mount := findMount(mounts, mountPoint)
+	return mount != nil && sameDevice(mount.Source, device), nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) bindMount(source string, mountPoint string) error {
+	err := prepareMountPoint(awsAsgEbs.hostPath(mountPoint), awsAsgEbs.ForceMountPoint)
+	if err != nil {
+		return err
+	}
+	return awsAsgEbs.runMount("/bin/mount", "--bind", source, mountPoint)
 }
 
 func (awsAsgEbs *AwsAsgEbs) checkDevice(device string) error {
@@ -344,13 +1207,58 @@ func (awsAsgEbs *AwsAsgEbs) checkDevice(device string) error {
 	return nil
 }
 
+func (awsAsgEbs *AwsAsgEbs) rootDevice() (string, error) {
+	return awsAsgEbs.Metadata.GetMetadata("block-device-mapping/root")
+}
+
 func (awsAsgEbs *AwsAsgEbs) checkMountPoint(mountPoint string) error {
-	if strings.Contains(slurpFile("/proc/mounts"), mountPoint) {
-		return errors.New("Already mounted")
+	mounts, err := readMountInfo(awsAsgEbs.mountInfoFile())
+	if err != nil {
+		return err
+	}
+	if mount := findMount(mounts, mountPoint); mount != nil {
+		return fmt.Errorf("already mounted: %s (%s)", mount.Source, mount.FsType)
 	}
 	return nil
 }
 
+// checkMounted checks that mountPoint is a mount point and, if writable, that
+// a file can be written to it.
+func (awsAsgEbs *AwsAsgEbs) checkMounted(mountPoint string, writable bool) error {
+	path := awsAsgEbs.hostPath(mountPoint)
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+	if !writable {
+		return nil
+	}
+	file, err := os.CreateTemp(path, ".asg-ebs-write-test-")
+	if err != nil {
+		return fmt.Errorf("write test on %s: %w", mountPoint, err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("asg-ebs\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write test on %s: %w", mountPoint, err)
+	}
+	return nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) lookupMount(mountPoint string) (*mountInfo, error) {
+	mounts, err := readMountInfo(awsAsgEbs.mountInfoFile())
+	if err != nil {
+		return nil, err
+	}
+	return findMount(mounts, mountPoint), nil
+}
+
 type CreateTagsValue map[string]string
 
 func (v CreateTagsValue) Set(str string) error {
@@ -368,6 +1276,108 @@ func (v CreateTagsValue) String() string {
 	return ""
 }
 
+// expandCreateName replaces {mount_point} in the volume name with the mount
+// point, e.g. "data-{mount_point}" and /var/lib/app give "data-var-lib-app".
+func expandCreateName(name string, mountPoint string) string {
+	sanitized := strings.Trim(filepath.Clean(mountPoint), "/")
+	if sanitized == "" {
+		sanitized = "root"
+	}
+	sanitized = strings.Replace(sanitized, "/", "-", -1)
+	return strings.Replace(name, "{mount_point}", sanitized, -1)
+}
+
+// TagValue is a single KEY=VALUE tag.
+type TagValue struct {
+	Key   string
+	Value string
+}
+
+func (v *TagValue) Set(str string) error {
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected KEY=VALUE got '%s'", str)
+	}
+	v.Key = parts[0]
+	v.Value = parts[1]
+	return nil
+}
+
+func (v *TagValue) String() string {
+	if v.Key == "" {
+		return ""
+	}
+	return v.Key + "=" + v.Value
+}
+
+func Tag(s kingpin.Settings) (target *TagValue) {
+	target = &TagValue{}
+	s.SetValue(target)
+	return
+}
+
+// TagListValue collects a repeated KEY=VALUE flag in order.
+type TagListValue []TagValue
+
+func (v *TagListValue) Set(str string) error {
+	tag := TagValue{}
+	if err := tag.Set(str); err != nil {
+		return err
+	}
+	*v = append(*v, tag)
+	return nil
+}
+
+func (v *TagListValue) String() string {
+	return ""
+}
+
+func TagList(s kingpin.Settings) (target *[]TagValue) {
+	target = &[]TagValue{}
+	s.SetValue((*TagListValue)(target))
+	return
+}
+
+// MountPointsValue collects a repeated --mount-point flag. The first
+// occurrence is where the volume is mounted, every further one is a bind
+// mount of it, made in the order given.
+type MountPointsValue struct {
+	mountPoint      *string
+	bindMountPoints *[]string
+}
+
+func (v MountPointsValue) Set(str string) error {
+	if *v.mountPoint == "" {
+		*v.mountPoint = str
+		return nil
+	}
+	*v.bindMountPoints = append(*v.bindMountPoints, str)
+	return nil
+}
+
+func (v MountPointsValue) String() string {
+	return ""
+}
+
+func MountPoints(s kingpin.Settings) (mountPoint *string, bindMountPoints *[]string) {
+	mountPoint = new(string)
+	bindMountPoints = &[]string{}
+	s.SetValue(MountPointsValue{mountPoint, bindMountPoints})
+	return
+}
+
+func validateMountPoints(mountPoints []string) error {
+	seen := map[string]bool{}
+	for _, mountPoint := range mountPoints {
+		mountPoint = filepath.Clean(mountPoint)
+		if seen[mountPoint] {
+			return fmt.Errorf("mount point %s given more than once", mountPoint)
+		}
+		seen[mountPoint] = true
+	}
+	return nil
+}
+
 func CreateTags(s kingpin.Settings) (target *map[string]string) {
 	newMap := make(map[string]string)
 	target = &newMap
@@ -375,123 +1385,1166 @@ func CreateTags(s kingpin.Settings) (target *map[string]string) {
 	return
 }
 
-func runAsgEbs(asgEbs AsgEbs, cfg Config) {
+// attachRetryMaxDelay caps the backoff between attempts to attach an
+// existing volume.
+var attachRetryMaxDelay = time.Minute
+
+// attachBackoff returns the delay after the failed attempt: delay doubled
+// per attempt, capped at attachRetryMaxDelay, with up to half of it taken
+// off at random so that instances started together spread out.
+func attachBackoff(delay time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt && delay < attachRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > attachRetryMaxDelay {
+		delay = attachRetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// attachExistingVolume attaches a volume with the tag, trying up to
+// --attach-retries times as other instances may grab the found volume
+// first. The last found volume is returned even if attaching it failed.
+func attachExistingVolume(asgEbs AsgEbs, cfg Config, tagKey string, tagValue string) (*string, bool, error) {
+	var volumeId *string
+	for i := 1; i <= *cfg.attachRetries; i++ {
+		var err error
+		volumeId, err = asgEbs.findVolume(tagKey, tagValue)
+		if err != nil {
+			return nil, false, wrapError(ErrVolumeLookupFailed, err)
+		}
+		if volumeId == nil {
+			return nil, false, nil
+		}
+		log.WithFields(log.Fields{"volume": *volumeId, "device": "/dev/" + *cfg.attachAs, "attempt": i}).Info("Trying to attach existing volume")
+		err = checkAvailabilityZone(asgEbs, *volumeId)
+		if err != nil {
+			return nil, false, wrapError(ErrAttachFailed, err)
+		}
+		start := time.Now()
+		err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Failed to attach volume")
+			if i < *cfg.attachRetries {
+				prometheusMetrics.increment("asg_ebs_attach_retries_total", nil)
+				time.Sleep(attachBackoff(*cfg.attachRetryDelay, i))
+			}
+			continue
+		}
+		metrics.timing("attach.duration", time.Since(start))
+		metrics.increment("volumes.reused")
+		log.WithFields(log.Fields{"volume": *volumeId, "tag_key": tagKey, "tag_value": tagValue}).Info("Attached existing volume")
+		return volumeId, true, nil
+	}
+	log.WithFields(log.Fields{"tag_key": tagKey, "tag_value": tagValue, "attempts": *cfg.attachRetries}).Warn("All attempts to attach an existing volume failed")
+	return volumeId, false, nil
+}
+
+func runAsgEbs(asgEbs AsgEbs, cfg Config) error {
 
 	createFileSystemOnVolume := false
+	restoredFromSnapshot := false
 	var volumeId *string
 	var snapshotId *string
-	attachAsDevice := "/dev/" + *cfg.attachAs
-
-	// Precondition checks
-	err := asgEbs.checkDevice(attachAsDevice)
+	attachAsDevice, err := asgEbs.attachedDevice(*cfg.attachAs)
 	if err != nil {
-		log.WithFields(log.Fields{"device": attachAsDevice}).Fatal("Device already exists")
+		return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", *cfg.attachAs, err))
 	}
 
-	err = asgEbs.checkMountPoint(*cfg.mountPoint)
-	if err != nil {
-		log.WithFields(log.Fields{"mount_point": *cfg.mountPoint}).Fatal("Already mounted")
+	if !*cfg.allowRootDevice {
+		root, err := asgEbs.rootDevice()
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("root device: %w", err))
+		}
+		if isRootDevice(*cfg.attachAs, root) {
+			return wrapError(ErrPrecondition, fmt.Errorf("device %s is the root device %s", attachAsDevice, root))
+		}
+	}
+
+	if *cfg.skipIfMounted {
+		mounted, err := alreadyMounted(asgEbs, cfg, attachAsDevice)
+		if err != nil {
+			return wrapError(ErrPrecondition, err)
+		}
+		if mounted {
+			log.WithFields(log.Fields{"device": attachAsDevice, "mount_point": *cfg.mountPoint}).Info("Already mounted, nothing to do")
+			return nil
+		}
+	}
+
+	if *cfg.cleanupDangling {
+		var err error
+		volumeId, createFileSystemOnVolume, err = recoverVolume(asgEbs, cfg)
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", attachAsDevice, err))
+		}
+	}
+
+	if *cfg.replaceDevice && volumeId == nil {
+		err := detachConflictingVolume(asgEbs, *cfg.attachAs, *cfg.detachTimeout)
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", attachAsDevice, err))
+		}
 	}
 
-	if *cfg.snapshotName == "" {
-		for i := 1; i <= 10; i++ {
-			volumeId, err = asgEbs.findVolume(*cfg.tagKey, *cfg.tagValue)
+	// Precondition checks
+	if volumeId == nil {
+		// --replace-device may have detached the volume found above.
+		attachAsDevice, err = asgEbs.attachedDevice(*cfg.attachAs)
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", *cfg.attachAs, err))
+		}
+		err = asgEbs.checkDevice(attachAsDevice)
+		switch {
+		case err == nil:
+		case *cfg.deviceExistsPolicy == "ignore":
+			log.WithFields(log.Fields{"device": attachAsDevice, "error": err}).Warn("Ignoring existing device")
+		case *cfg.deviceExistsPolicy == "reuse":
+			volumeId, createFileSystemOnVolume, err = recoverVolume(asgEbs, cfg)
 			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Fatal("Failed to find volume")
+				return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", attachAsDevice, err))
 			}
 			if volumeId == nil {
-				break
-			} else {
-				log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice, "attempt": i}).Info("Trying to attach existing volume")
-				err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Warn("Failed to attach volume")
-				} else {
-					break
-				}
+				return wrapError(ErrPrecondition, fmt.Errorf("device %s: exists and is not a volume asg-ebs manages", attachAsDevice))
+			}
+		default:
+			return wrapError(ErrPrecondition, fmt.Errorf("device %s: %w", attachAsDevice, err))
+		}
+	}
+
+	// With --overlay-lowerdir the volume only holds the upper layer and the
+	// overlay is mounted at the mount point.
+	volumeMountPoint := *cfg.mountPoint
+	if *cfg.overlayLowerDir != "" {
+		err = checkLowerDir(*cfg.overlayLowerDir)
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("overlay lower directory: %w", err))
+		}
+		volumeMountPoint = *cfg.overlayVolumeMountPoint
+	}
+
+	for _, mountPoint := range append([]string{volumeMountPoint, *cfg.mountPoint}, *cfg.bindMountPoints...) {
+		err = asgEbs.checkMountPoint(mountPoint)
+		if err != nil {
+			return wrapError(ErrPrecondition, fmt.Errorf("mount point %s: %w", mountPoint, err))
+		}
+	}
+
+	if volumeId != nil {
+		log.WithFields(log.Fields{"volume": *volumeId}).Info("Using recovered volume")
+	} else if *cfg.multiAttach {
+		volumeId, createFileSystemOnVolume, err = attachClusterVolume(asgEbs, cfg)
+		if err != nil {
+			return err
+		}
+	} else if *cfg.cloneVolumeId != "" {
+		snapshotId, err = cloneSnapshot(asgEbs, *cfg.cloneVolumeId, *cfg.mountPoint)
+		if err != nil {
+			return wrapError(ErrSnapshotFailed, fmt.Errorf("clone of %s: %w", *cfg.cloneVolumeId, err))
+		}
+	} else if len(snapshotTags(cfg)) == 0 {
+		var attached bool
+		volumeId, attached, err = attachExistingVolume(asgEbs, cfg, *cfg.tagKey, *cfg.tagValue)
+		if err != nil {
+			return err
+		}
+		if !attached && cfg.fallbackTag.Key != "" {
+			log.WithFields(log.Fields{"tag_key": cfg.fallbackTag.Key, "tag_value": cfg.fallbackTag.Value}).Info("No volume attached, trying fallback tag")
+			fallbackVolumeId, fallbackAttached, err := attachExistingVolume(asgEbs, cfg, cfg.fallbackTag.Key, cfg.fallbackTag.Value)
+			if err != nil {
+				return err
+			}
+			if fallbackAttached || volumeId == nil {
+				volumeId = fallbackVolumeId
 			}
 		}
 	} else {
-		snapshotId, err = asgEbs.findSnapshot("Name", *cfg.snapshotName)
+		snapshotId, err = findSnapshotByTags(asgEbs, snapshotTags(cfg))
+		if err != nil {
+			return wrapError(ErrVolumeLookupFailed, err)
+		}
+	}
+
+	if volumeId == nil && snapshotId == nil && *cfg.noCreate {
+		return wrapError(ErrVolumeLookupFailed, fmt.Errorf("no volume with tag %s=%s and --no-create is set", *cfg.tagKey, *cfg.tagValue))
+	}
+
+	if volumeId == nil && *cfg.maxTotalSize > 0 {
+		size, err := asgEbs.attachedVolumesSize()
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "snapshot_name": *cfg.snapshotName}).Fatal("Failed to find snapshot")
+			return wrapError(ErrCreateFailed, fmt.Errorf("size of attached volumes: %w", err))
 		}
+		if size+*cfg.createSize > *cfg.maxTotalSize {
+			return wrapError(ErrCreateFailed, fmt.Errorf("attached volumes of %d GiB and the new volume of %d GiB exceed --max-total-size of %d GiB", size, *cfg.createSize, *cfg.maxTotalSize))
+		}
+	}
+
+	// An empty volume would need a file system, which cannot be created on
+	// a volume that is mounted read-only.
+	if volumeId == nil && snapshotId == nil && *cfg.readOnly {
+		return wrapError(ErrPrecondition, fmt.Errorf("no volume with tag %s=%s found and --read-only cannot be used with a new empty volume", *cfg.tagKey, *cfg.tagValue))
 	}
 
 	if volumeId == nil {
 		log.Info("Creating new volume")
-		volumeId, err = asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, snapshotId)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to create new volume")
+		if *cfg.estimateCost {
+			logCostEstimate(*cfg.createSize, *cfg.createVolumeType, *cfg.createIops, *cfg.createThroughput)
 		}
-		log.WithFields(log.Fields{"volume": *volumeId}).Info("Waiting until new volume is available")
-		err = asgEbs.waitUntilVolumeAvailable(*volumeId)
+		volumeId, err = createVolumeWithCapacityRetry(asgEbs, cfg, snapshotId)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Fatal("Waiting for volume timed out")
+			return wrapError(ErrCreateFailed, err)
+		}
+		metrics.increment("volumes.created")
+		// An empty volume is available within seconds, so instead of the
+		// waiter's polling cycle the attach is retried until it is.
+		skipWaitAvailable := *cfg.skipWaitAvailable && snapshotId == nil
+		if skipWaitAvailable {
+			log.WithFields(log.Fields{"volume": *volumeId}).Info("Not waiting until new volume is available")
+		} else {
+			log.WithFields(log.Fields{"volume": *volumeId}).Info("Waiting until new volume is available")
+			err = asgEbs.waitUntilVolumeAvailable(*volumeId)
+			if err != nil {
+				return wrapError(ErrVolumeNotAvailable, fmt.Errorf("volume %s: %w", *volumeId, err))
+			}
 		}
 		if snapshotId == nil {
 			createFileSystemOnVolume = true
+		} else {
+			restoredFromSnapshot = true
+		}
+		if *cfg.cloneVolumeId != "" && *cfg.cloneDeleteSnapshot {
+			log.WithFields(log.Fields{"snapshot": *snapshotId}).Info("Deleting clone snapshot")
+			err = asgEbs.deleteSnapshot(*snapshotId)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "snapshot": *snapshotId}).Warn("Failed to delete clone snapshot")
+			}
 		}
 		log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice}).Info("Attaching volume")
+		err = checkAvailabilityZone(asgEbs, *volumeId)
+		if err != nil {
+			return wrapError(ErrAttachFailed, err)
+		}
+		start := time.Now()
 		err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+		for i := 1; skipWaitAvailable && isIncorrectState(err) && i < attachPendingRetries; i++ {
+			log.WithFields(log.Fields{"volume": *volumeId, "attempt": i}).Info("New volume is not available yet, retrying attach")
+			time.Sleep(attachPendingDelay)
+			err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+		}
+		if err != nil {
+			return wrapError(ErrAttachFailed, fmt.Errorf("volume %s: %w", *volumeId, err))
+		}
+		metrics.timing("attach.duration", time.Since(start))
+		metrics.increment("volumes.attached")
+	} else if *cfg.ensureTags {
+		tags := map[string]string{"Name": *cfg.createName}
+		for k, v := range *cfg.createTags {
+			tags[k] = v
+		}
+		err = asgEbs.ensureTags(*volumeId, tags)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Warn("Failed to reconcile volume tags")
+		}
+	}
+
+	device := asgEbs.devicePath(*volumeId, *cfg.attachAs)
+
+	if *cfg.thinPool {
+		virtualSize := *cfg.thinVolumeSize
+		if virtualSize == 0 {
+			virtualSize = *cfg.createSize
+		}
+		device, err = asgEbs.setupThinPool(device, *volumeId, createFileSystemOnVolume, virtualSize)
+		if err != nil {
+			return wrapError(ErrFormatFailed, fmt.Errorf("thin pool: %w", err))
+		}
+	}
+
+	if *cfg.verityRootHash != "" {
+		device, err = asgEbs.openVerity(device, *volumeId, *cfg.verityRootHash, *cfg.verityHashOffset)
+		if err != nil {
+			return wrapError(ErrMountFailed, fmt.Errorf("dm-verity: %w", err))
+		}
+	}
+
+	if !createFileSystemOnVolume && *cfg.verifyFileSystem {
+		hasFileSystem, err := asgEbs.hasFileSystem(device)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to attach volume")
+			return wrapError(ErrFormatFailed, err)
+		}
+		if !hasFileSystem && *cfg.readOnly {
+			return wrapError(ErrFormatFailed, fmt.Errorf("volume %s has no file system and --read-only is set", *volumeId))
+		}
+		// Only the instance that created a cluster volume formats it, the
+		// others would destroy the file system it is creating.
+		if !hasFileSystem && *cfg.multiAttach {
+			return wrapError(ErrFormatFailed, fmt.Errorf("cluster volume %s has no file system", *volumeId))
+		}
+		if !hasFileSystem {
+			log.WithFields(log.Fields{"volume": *volumeId, "device": device}).Warn("Volume has no file system although it was expected to")
+			createFileSystemOnVolume = true
 		}
 	}
 
+	mkfs := newMkfsConfig(cfg)
 	if createFileSystemOnVolume {
-		log.WithFields(log.Fields{"device": attachAsDevice}).Info("Creating file system on new volume")
-		err = asgEbs.makeFileSystem(attachAsDevice, *cfg.mkfsInodeRatio, *volumeId)
+		log.WithFields(log.Fields{"device": device}).Info("Creating file system on new volume")
+		err = asgEbs.makeFileSystem(device, mkfs, *volumeId)
+		if err != nil {
+			return wrapError(ErrFormatFailed, err)
+		}
+	} else if mkfs.uuid != "" && *cfg.fsUuidOnReuse && !*cfg.readOnly {
+		log.WithFields(log.Fields{"device": device, "uuid": mkfs.uuid}).Info("Setting file system UUID")
+		err = asgEbs.setFileSystemUUID(device, mkfs.fsType, mkfs.uuid)
+		if err != nil {
+			return wrapError(ErrFormatFailed, err)
+		}
+	}
+
+	if *cfg.pauseBeforeMount != "" {
+		log.WithFields(log.Fields{"volume": *volumeId, "device": device, "mount_point": *cfg.mountPoint, "continue_file": *cfg.pauseBeforeMount}).Warn("Pausing before mount, create the continue file to go on")
+		err = waitForSentinel(*cfg.pauseBeforeMount, time.Second, *cfg.pauseTimeout)
+		if err != nil {
+			return wrapError(ErrMountFailed, err)
+		}
+		log.Info("Continue file found, resuming")
+	}
+
+	log.WithFields(log.Fields{"device": device, "mount_point": volumeMountPoint}).Info("Mounting volume")
+	err = asgEbs.mountVolume(device, volumeMountPoint)
+	if err != nil {
+		return wrapError(ErrMountFailed, err)
+	}
+
+	// A volume restored from a snapshot may be larger than the snapshot, the
+	// file system is grown after mounting as xfs can only grow mounted.
+	growRestored := restoredFromSnapshot && *cfg.growFileSystem
+	if !createFileSystemOnVolume && !*cfg.readOnly && (*cfg.autoResize || growRestored) {
+		err = asgEbs.growFileSystem(device, volumeMountPoint)
+		if err != nil {
+			return wrapError(ErrResizeFailed, err)
+		}
+	}
+
+	if *cfg.persistFstab {
+		err = asgEbs.persistMount(device, volumeMountPoint)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "mount_point": volumeMountPoint}).Warn("Failed to add mount to fstab")
+		}
+	}
+
+	if *cfg.systemdMount {
+		err = asgEbs.installMountUnit(device, volumeMountPoint)
+		if err != nil {
+			return wrapError(ErrMountFailed, fmt.Errorf("mount unit: %w", err))
+		}
+	}
+
+	if *cfg.reportUsage {
+		usage, err := asgEbs.fileSystemUsage(volumeMountPoint)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "mount_point": volumeMountPoint}).Warn("Failed to get file system usage")
+		} else {
+			log.WithFields(log.Fields{"mount_point": volumeMountPoint, "total": usage.Total, "used": usage.Used, "free": usage.Free}).Info("File system usage")
+		}
+	}
+
+	if *cfg.overlayLowerDir != "" {
+		log.WithFields(log.Fields{"lower_dir": *cfg.overlayLowerDir, "volume_mount_point": volumeMountPoint, "mount_point": *cfg.mountPoint}).Info("Mounting overlay")
+		err = asgEbs.overlayMount(*cfg.overlayLowerDir, volumeMountPoint, *cfg.mountPoint)
+		if err != nil {
+			return wrapError(ErrMountFailed, fmt.Errorf("overlay: %w", err))
+		}
+	}
+
+	for _, mountPoint := range *cfg.bindMountPoints {
+		log.WithFields(log.Fields{"source": *cfg.mountPoint, "mount_point": mountPoint}).Info("Bind mounting volume")
+		err = asgEbs.bindMount(*cfg.mountPoint, mountPoint)
+		if err != nil {
+			return wrapError(ErrMountFailed, err)
+		}
+	}
+
+	if cfg.readinessTag.Key != "" {
+		// A tag left by a previous run must not claim readiness of a mount
+		// that does not work.
+		err = asgEbs.checkMounted(*cfg.mountPoint, !*cfg.readOnly)
+		if err != nil {
+			log.WithFields(log.Fields{"volume": *volumeId, "tag_key": cfg.readinessTag.Key}).Warn("Mount is not usable, clearing readiness tag")
+			if err := asgEbs.deleteTag(*volumeId, cfg.readinessTag.Key); err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Warn("Failed to clear readiness tag")
+			}
+			return wrapError(ErrMountFailed, err)
+		}
+		log.WithFields(log.Fields{"volume": *volumeId, "tag_key": cfg.readinessTag.Key, "tag_value": cfg.readinessTag.Value}).Info("Setting readiness tag")
+		err = asgEbs.setReadinessTag(*volumeId, cfg.readinessTag.Key, cfg.readinessTag.Value)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Warn("Failed to set readiness tag")
+		}
+	}
+
+	return nil
+}
+
+// danglingVolume returns the volume a previous run attached as attachAs but
+// did not mount, if it carries the tag asg-ebs searches for. Unrelated and
+// mounted volumes are left alone.
+func danglingVolume(asgEbs AsgEbs, attachAs string, tagKey string, tagValue string) (*string, map[string]string, error) {
+	volumeId, isRoot, err := asgEbs.attachedVolume(attachAs)
+	if err != nil || volumeId == nil || isRoot {
+		return nil, nil, err
+	}
+	device := asgEbs.devicePath(*volumeId, attachAs)
+	tags, err := asgEbs.volumeTags(*volumeId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if value, ok := tags[tagKey]; !ok || value != tagValue {
+		log.WithFields(log.Fields{"volume": *volumeId, "device": device}).Info("Attached volume does not have the tag, leaving it alone")
+		return nil, nil, nil
+	}
+	mounts, err := asgEbs.deviceMounts(device)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(mounts) > 0 {
+		log.WithFields(log.Fields{"volume": *volumeId, "device": device, "mount_point": mounts[0].MountPoint}).Info("Attached volume is mounted, leaving it alone")
+		return nil, nil, nil
+	}
+	return volumeId, tags, nil
+}
+
+// recoverVolume returns the volume attached as attachAs by a previous run
+// and whether it still needs a file system.
+func recoverVolume(asgEbs AsgEbs, cfg Config) (*string, bool, error) {
+	volumeId, tags, err := danglingVolume(asgEbs, *cfg.attachAs, *cfg.tagKey, *cfg.tagValue)
+	if err != nil || volumeId == nil {
+		return nil, false, err
+	}
+	// A run that crashed between attach and mkfs leaves the volume tagged
+	// filesystem=false.
+	createFileSystem := tags[*cfg.filesystemMarkerTag] == "false"
+	log.WithFields(log.Fields{"volume": *volumeId, "device": asgEbs.devicePath(*volumeId, *cfg.attachAs), "create_file_system": createFileSystem}).Warn("Recovering volume left attached by a previous run")
+	return volumeId, createFileSystem, nil
+}
+
+// alreadyMounted returns whether the volume attached as attachAsDevice is
+// mounted at the mount point, and an error if something else is. With
+// --thin-pool the mount source is the thin volume on the volume, with
+// --verity-root-hash the dm-verity device. With
+// --overlay-lowerdir the mount point is an overlay and the volume is
+// mounted at --overlay-volume-mount-point.
+func alreadyMounted(asgEbs AsgEbs, cfg Config, attachAsDevice string) (bool, error) {
+	mountPoint := *cfg.mountPoint
+	if *cfg.overlayLowerDir != "" {
+		overlay, err := asgEbs.lookupMount(mountPoint)
+		if err != nil {
+			return false, err
+		}
+		if overlay == nil {
+			return false, nil
+		}
+		if overlay.FsType != "overlay" {
+			return false, fmt.Errorf("mount point %s: already mounted: %s (%s)", mountPoint, overlay.Source, overlay.FsType)
+		}
+		mountPoint = *cfg.overlayVolumeMountPoint
+	}
+
+	mount, err := asgEbs.lookupMount(mountPoint)
+	if err != nil {
+		return false, err
+	}
+	if mount == nil {
+		if mountPoint != *cfg.mountPoint {
+			return false, fmt.Errorf("mount point %s: overlay is mounted, but not the volume at %s", *cfg.mountPoint, mountPoint)
+		}
+		return false, nil
+	}
+
+	devices := []string{attachAsDevice}
+	if *cfg.thinPool || *cfg.verityRootHash != "" {
+		volumeId, _, err := asgEbs.attachedVolume(*cfg.attachAs)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to create file system")
+			return false, err
+		}
+		if volumeId != nil && *cfg.thinPool {
+			devices = []string{thinVolumeDevice(*volumeId), thinVolumeMapperDevice(*volumeId)}
+		}
+		if volumeId != nil && *cfg.verityRootHash != "" {
+			devices = []string{verityDevice(*volumeId)}
+		}
+	}
+	for _, device := range devices {
+		if sameDevice(mount.Source, device) {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("mount point %s: already mounted: %s (%s)", mountPoint, mount.Source, mount.FsType)
+}
+
+// detachConflictingVolume unmounts and detaches whatever volume is attached
+// to this instance as attachAs. It never touches the root volume, and
+// unmounting fails if the file system is still in use.
+func detachConflictingVolume(asgEbs AsgEbs, attachAs string, timeout time.Duration) error {
+	volumeId, isRoot, err := asgEbs.attachedVolume(attachAs)
+	if err != nil {
+		return err
+	}
+	if volumeId == nil {
+		return nil
+	}
+	if isRoot {
+		return fmt.Errorf("refusing to replace root volume %s", *volumeId)
+	}
+	device := asgEbs.devicePath(*volumeId, attachAs)
+	log.WithFields(log.Fields{"volume": *volumeId, "device": device}).Warn("Unmounting conflicting volume")
+	err = asgEbs.unmountDevice(device)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"volume": *volumeId, "device": device}).Warn("Detaching conflicting volume")
+	err = detachAndWait(asgEbs, *volumeId, timeout)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"volume": *volumeId, "device": device}).Info("Detached conflicting volume")
+	return nil
+}
+
+// capacityRetryDelay is the initial delay between CreateVolume attempts
+// failing for a lack of capacity. It doubles up to capacityRetryMaxDelay.
+var (
+	capacityRetryDelay    = 5 * time.Second
+	capacityRetryMaxDelay = time.Minute
+)
+
+// attachPendingDelay and attachPendingRetries bound retrying to attach a new
+// volume that is still being created with --skip-wait-available.
+var (
+	attachPendingDelay   = time.Second
+	attachPendingRetries = 60
+)
+
+func isIncorrectState(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "IncorrectState"
+}
+
+// isKmsError reports whether EC2 rejected the request because of the KMS
+// key, e.g. KMS.NotFoundException or InvalidKMSKey.Id.
+func isKmsError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && (strings.HasPrefix(awsErr.Code(), "KMS.") || strings.HasPrefix(awsErr.Code(), "InvalidKMSKey"))
+}
+
+func isInsufficientCapacity(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "InsufficientVolumeCapacity"
+}
+
+// createVolumeWithCapacityRetry creates the volume, retrying for
+// --capacity-retry-window while the availability zone lacks capacity and
+// trying --capacity-fallback-volume-type once the window has passed.
+func createVolumeWithCapacityRetry(asgEbs AsgEbs, cfg Config, snapshotId *string) (*string, error) {
+	volumeId, err := asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, snapshotId)
+	if err == nil || !*cfg.capacityRetry || !isInsufficientCapacity(err) {
+		return volumeId, err
+	}
+
+	deadline := time.Now().Add(*cfg.capacityRetryWindow)
+	delay := capacityRetryDelay
+	for attempt := 2; time.Now().Add(delay).Before(deadline); attempt++ {
+		log.WithFields(log.Fields{"error": err, "volume_type": *cfg.createVolumeType, "delay": delay, "attempt": attempt}).Warn("Insufficient volume capacity, retrying")
+		time.Sleep(delay)
+		volumeId, err = asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, snapshotId)
+		if err == nil {
+			log.WithFields(log.Fields{"volume_type": *cfg.createVolumeType, "attempt": attempt}).Info("Created volume after capacity retry")
+			return volumeId, nil
 		}
+		if !isInsufficientCapacity(err) {
+			return nil, err
+		}
+		delay *= 2
+		if delay > capacityRetryMaxDelay {
+			delay = capacityRetryMaxDelay
+		}
+	}
+
+	if *cfg.capacityFallbackVolumeType == "" {
+		log.WithFields(log.Fields{"volume_type": *cfg.createVolumeType, "window": *cfg.capacityRetryWindow}).Warn("Insufficient volume capacity, giving up")
+		return nil, err
 	}
+	log.WithFields(log.Fields{"volume_type": *cfg.createVolumeType, "fallback_volume_type": *cfg.capacityFallbackVolumeType}).Warn("Insufficient volume capacity, falling back to another volume type")
+	return asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.capacityFallbackVolumeType, *cfg.createTags, snapshotId)
+}
 
-	log.WithFields(log.Fields{"device": attachAsDevice, "mount_point": *cfg.mountPoint}).Info("Mounting volume")
-	err = asgEbs.mountVolume(attachAsDevice, *cfg.mountPoint)
+// checkAvailabilityZone fails if the volume is in another availability zone
+// than the instance, which AttachVolume would only reject with a much less
+// helpful error.
+func checkAvailabilityZone(asgEbs AsgEbs, volumeId string) error {
+	volumeAz, err := asgEbs.volumeAvailabilityZone(volumeId)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Failed to mount volume")
+		return err
+	}
+	if instanceAz := asgEbs.availabilityZone(); volumeAz != instanceAz {
+		return fmt.Errorf("volume %s is in availability zone %s but the instance is in %s", volumeId, volumeAz, instanceAz)
 	}
+	return nil
+}
+
+// snapshotTags returns the tags to restore a snapshot by, in the order they
+// are tried: --snapshot-tag-value or --snapshot-name first, then each
+// --snapshot-tag.
+func snapshotTags(cfg Config) []TagValue {
+	tags := []TagValue{}
+	if *cfg.snapshotTagValue != "" {
+		key := *cfg.snapshotTagKey
+		if key == "" {
+			key = "Name"
+		}
+		tags = append(tags, TagValue{Key: key, Value: *cfg.snapshotTagValue})
+	} else if *cfg.snapshotName != "" {
+		tags = append(tags, TagValue{Key: "Name", Value: *cfg.snapshotName})
+	}
+	return append(tags, *cfg.snapshotTags...)
+}
+
+// findSnapshotByTags returns the latest completed snapshot with the first
+// of tags any snapshot that fits the volume has. It fails if snapshots were
+// found, but none of them fits.
+func findSnapshotByTags(asgEbs AsgEbs, tags []TagValue) (*string, error) {
+	var tooLarge error
+	for _, tag := range tags {
+		snapshotId, err := asgEbs.findSnapshot(tag.Key, tag.Value)
+		if errors.Is(err, errNoFittingSnapshot) {
+			tooLarge = err
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", tag.String(), err)
+		}
+		if snapshotId != nil {
+			return snapshotId, nil
+		}
+		log.WithFields(log.Fields{"tag_key": tag.Key, "tag_value": tag.Value}).Info("No snapshot with tag")
+	}
+	return nil, tooLarge
+}
 
+// cloneSnapshot snapshots the source volume of a clone and waits until the
+// snapshot can be used to create the new volume.
+func cloneSnapshot(asgEbs AsgEbs, sourceVolumeId string, mountPoint string) (*string, error) {
+	log.WithFields(log.Fields{"volume": sourceVolumeId}).Info("Creating snapshot of volume to clone")
+	tags := map[string]string{"clone-source": sourceVolumeId, "mount-point": mountPoint}
+	snapshotId, err := asgEbs.createSnapshot(sourceVolumeId, "asg-ebs clone of "+sourceVolumeId, tags)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"volume": sourceVolumeId, "snapshot": *snapshotId}).Info("Waiting until snapshot is completed")
+	err = asgEbs.waitUntilSnapshotCompleted(*snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotId, nil
 }
 
 type Config struct {
-	tagKey              *string
-	tagValue            *string
-	attachAs            *string
-	mountPoint          *string
-	createSize          *int64
-	mkfsInodeRatio      *int64
-	createName          *string
-	createVolumeType    *string
-	createTags          *map[string]string
-	deleteOnTermination *bool
-	snapshotName        *string
-	maxRetries          *int
+	tagKey                     *string
+	tagValue                   *string
+	tagValueFromInstanceTag    *string
+	fallbackTag                *TagValue
+	noCreate                   *bool
+	logCandidates              *bool
+	volumeSelection            *string
+	requireFilesystemTag       *bool
+	filesystemMarkerTag        *string
+	attachAs                   *string
+	autoAttachAs               *bool
+	allowRootDevice            *bool
+	mountPoint                 *string
+	bindMountPoints            *[]string
+	forceMountPoint            *bool
+	forceFormat                *bool
+	readOnly                   *bool
+	persistFstab               *bool
+	systemdMount               *bool
+	mountRetries               *int
+	overlayLowerDir            *string
+	overlayVolumeMountPoint    *string
+	attachTimeout              *time.Duration
+	detachTimeout              *time.Duration
+	attachRetries              *int
+	attachRetryDelay           *time.Duration
+	mountProfile               *string
+	pauseBeforeMount           *string
+	pauseTimeout               *time.Duration
+	mountNamespace             *int
+	createSize                 *int64
+	maxTotalSize               *int64
+	mkfsInodeRatio             *int64
+	filesystemType             *string
+	mkfsBlockSize              *int64
+	mkfsOptions                *string
+	mkfsIonice                 *bool
+	mkfsTimeout                *time.Duration
+	thinPool                   *bool
+	verityRootHash             *string
+	verityHashOffset           *int64
+	thinVolumeSize             *int64
+	fsUuid                     *string
+	fsUuidOnReuse              *bool
+	verifyFileSystem           *bool
+	autoResize                 *bool
+	growFileSystem             *bool
+	reportUsage                *bool
+	createName                 *string
+	createVolumeType           *string
+	createIops                 *int64
+	createThroughput           *int64
+	volumeInitializationRate   *int64
+	multiAttach                *bool
+	clusterWaitTimeout         *time.Duration
+	clusterLockTable           *string
+	clusterJournals            *int64
+	encrypted                  *bool
+	kmsKeyId                   *string
+	createTags                 *map[string]string
+	estimateCost               *bool
+	ensureTags                 *bool
+	readinessTag               *TagValue
+	daemon                     *bool
+	snapshotOnExit             *bool
+	waitForSnapshot            *bool
+	detachOnExit               *bool
+	credentialCheckInterval    *time.Duration
+	skipWaitAvailable          *bool
+	capacityRetry              *bool
+	capacityRetryWindow        *time.Duration
+	capacityFallbackVolumeType *string
+	deleteOnTermination        *bool
+	snapshotName               *string
+	snapshotTagKey             *string
+	snapshotTagValue           *string
+	inheritSnapshotTags        *bool
+	snapshotTags               *[]TagValue
+	snapshotOwner              *string
+	preferSourceAz             *bool
+	cloneVolumeId              *string
+	cloneDeleteSnapshot        *bool
+	skipIfMounted              *bool
+	replaceDevice              *bool
+	cleanupDangling            *bool
+	deviceExistsPolicy         *string
+	maxRetries                 *int
+	metadataRetries            *int
+	endpointUrl                *string
+	region                     *string
+	availabilityZone           *string
+	instanceId                 *string
+	operationMaxRetries        *map[string]int
+	affinityTag                *string
+	devicePollInterval         *time.Duration
+	useById                    *bool
+	refreshInstanceId          *bool
+	apiRateLimit               *float64
+	logAwsRetries              *bool
+	journald                   *bool
+	logFormat                  *string
+	logLevel                   *string
+	statsdAddr                 *string
+	metricsListen              *string
+	tagOverwriteProtection     *bool
 }
 
-func main() {
+func configureLogging(format string, level string) error {
+	if format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(logLevel)
+	return nil
+}
+
+// newAwsAsgEbsFromConfig applies the global flags shared by all commands.
+func newAwsAsgEbsFromConfig(cfg Config) (*AwsAsgEbs, error) {
+	env := awsEnvironment{
+		Endpoint:         *cfg.endpointUrl,
+		Region:           *cfg.region,
+		AvailabilityZone: *cfg.availabilityZone,
+		InstanceId:       *cfg.instanceId,
+	}
+	awsAsgEbs, err := NewAwsAsgEbs(*cfg.maxRetries, *cfg.metadataRetries, env)
+	if err != nil {
+		return nil, err
+	}
+	awsAsgEbs.LogRetries = *cfg.logAwsRetries
+	awsAsgEbs.OperationRetries = *cfg.operationMaxRetries
+	if *cfg.apiRateLimit > 0 {
+		awsAsgEbs.RateLimiter = newRateLimiter(*cfg.apiRateLimit)
+	}
+	return awsAsgEbs, nil
+}
+
+// attachFlags registers the flags of attach on command and returns them
+// together with the global flags. validate registers them as well, so it
+// takes the same command line as attach.
+func attachFlags(attach *kingpin.CmdClause, global *Config) *Config {
 	cfg := &Config{
-		tagKey:              kingpin.Flag("tag-key", "The tag key to search for").Required().PlaceHolder("KEY").String(),
-		tagValue:            kingpin.Flag("tag-value", "The tag value to search for").Required().PlaceHolder("VALUE").String(),
-		attachAs:            kingpin.Flag("attach-as", "device name e.g. xvdb").Required().PlaceHolder("DEVICE").String(),
-		mountPoint:          kingpin.Flag("mount-point", "Directory where the volume will be mounted").Required().PlaceHolder("DIR").String(),
-		createSize:          kingpin.Flag("create-size", "The size of the created volume, in GiBs").Required().PlaceHolder("SIZE").Int64(),
-		mkfsInodeRatio:      kingpin.Flag("mkfs-inode-ratio", "mkfs.ext4 inode ratio (-i)").Default("16384").Int64(),
-		createName:          kingpin.Flag("create-name", "The name of the created volume").Required().PlaceHolder("NAME").String(),
-		createVolumeType:    kingpin.Flag("create-volume-type", "The volume type of the created volume. This can be `gp2` for General Purpose (SSD) volumes or `standard` for Magnetic volumes").Required().PlaceHolder("TYPE").Enum("standard", "gp2"),
-		createTags:          CreateTags(kingpin.Flag("create-tags", "Tag to use for the new volume, can be specified multiple times").PlaceHolder("KEY=VALUE")),
-		deleteOnTermination: kingpin.Flag("delete-on-termination", "Delete volume when instance is terminated").Bool(),
-		snapshotName:        kingpin.Flag("snapshot-name", "Name of snapshot to use for new volume").String(),
+		tagKey:                     attach.Flag("tag-key", "The tag key to search for").Required().PlaceHolder("KEY").String(),
+		tagValue:                   attach.Flag("tag-value", "The tag value to search for").PlaceHolder("VALUE").String(),
+		tagValueFromInstanceTag:    attach.Flag("tag-value-from-instance-tag", "Use the value of this tag of the instance as --tag-value").PlaceHolder("KEY").String(),
+		fallbackTag:                Tag(attach.Flag("fallback-tag", "Tag of volumes to try when none with --tag-key and --tag-value can be attached").PlaceHolder("KEY=VALUE")),
+		noCreate:                   attach.Flag("no-create", "Fail instead of creating a new empty volume when no volume is found").Bool(),
+		logCandidates:              attach.Flag("log-candidates", "Log all volumes matching the tags before one is picked").Bool(),
+		volumeSelection:            attach.Flag("volume-selection", "How to choose among matching volumes: the `oldest` or `newest` by creation time, the `first` EC2 lists or `best-fit`, the smallest of at least --create-size").Default("oldest").Enum("oldest", "newest", "first", "best-fit"),
+		requireFilesystemTag:       attach.Flag("require-filesystem-tag", "Only reuse volumes tagged filesystem=true, use --no-require-filesystem-tag to also reuse volumes formatted elsewhere").Default("true").Bool(),
+		filesystemMarkerTag:        attach.Flag("filesystem-marker-tag", "Key of the tag marking volumes asg-ebs formatted").Default("filesystem").PlaceHolder("KEY").String(),
+		attachAs:                   attach.Flag("attach-as", "device name e.g. xvdb").PlaceHolder("DEVICE").String(),
+		autoAttachAs:               attach.Flag("auto-attach-as", "Attach as the next free device name from xvdf to xvdp according to the instance metadata").Bool(),
+		allowRootDevice:            attach.Flag("allow-root-device", "Allow --attach-as to name the root device of the instance").Bool(),
+		forceMountPoint:            attach.Flag("force-mountpoint", "Remove a file or broken symlink in place of the mount point directory").Bool(),
+		forceFormat:                attach.Flag("force-format", "Create the file system even if blkid finds one on the device, destroying its data").Bool(),
+		readOnly:                   attach.Flag("read-only", "Mount the volume read-only, the volume must already have a file system").Bool(),
+		persistFstab:               attach.Flag("persist-fstab", "Add the mount to /etc/fstab so it survives a reboot, best effort as the root file system may be read-only").Bool(),
+		systemdMount:               attach.Flag("systemd-mount", "Install and enable a systemd mount unit for the mount, skipped without systemd").Bool(),
+		mountRetries:               attach.Flag("mount-retries", "How often to retry a failed mount").Default("0").Int(),
+		overlayLowerDir:            attach.Flag("overlay-lowerdir", "Mount this directory overlaid with the volume at the mount point").PlaceHolder("DIR").String(),
+		overlayVolumeMountPoint:    attach.Flag("overlay-volume-mount-point", "Where to mount the volume holding the overlay upper layer").PlaceHolder("DIR").String(),
+		attachTimeout:              attach.Flag("attach-timeout", "How long to wait for the volume to be attached to this instance").Default("10m").Duration(),
+		detachTimeout:              attach.Flag("detach-timeout", "How long to wait for a detached volume to become available").Default("5m").Duration(),
+		attachRetries:              attach.Flag("attach-retries", "How often to try attaching an existing volume").Default("10").Int(),
+		attachRetryDelay:           attach.Flag("attach-retry-delay", "Initial delay between attempts to attach an existing volume, doubled per attempt").Default("2s").Duration(),
+		mountProfile:               attach.Flag("mount-profile", "Mount with the options of this profile for the file system type: throughput, durability or latency").PlaceHolder("PROFILE").Enum(mountProfileNames()...),
+		pauseBeforeMount:           attach.Flag("pause-before-mount", "Debugging only: wait before mounting until this file is created").PlaceHolder("FILE").String(),
+		pauseTimeout:               attach.Flag("pause-timeout", "How long --pause-before-mount waits for the continue file before failing").Default("1h").Duration(),
+		mountNamespace:             attach.Flag("mount-namespace", "Mount in the mount namespace of this PID, e.g. 1 for the host when running in a container").PlaceHolder("PID").Int(),
+		createSize:                 attach.Flag("create-size", "The size of the created volume, in GiBs").Required().PlaceHolder("SIZE").Int64(),
+		maxTotalSize:               attach.Flag("max-total-size", "Refuse to create a volume when it and the volumes attached to the instance exceed this size in GiBs, 0 for no limit").Default("0").Int64(),
+		mkfsInodeRatio:             attach.Flag("mkfs-inode-ratio", "mkfs inode ratio (-i) of ext file systems").Default("16384").Int64(),
+		filesystemType:             attach.Flag("filesystem-type", "The file system to create on new volumes: `ext4`, `ext3`, `xfs` or with --multi-attach the cluster file systems `gfs2` and `ocfs2`").Default("ext4").Enum("ext4", "ext3", "xfs", "gfs2", "ocfs2"),
+		mkfsBlockSize:              attach.Flag("mkfs-block-size", "File system block size in bytes, 0 for the mkfs default").Default("0").Int64(),
+		mkfsOptions:                attach.Flag("mkfs-options", "Options passed to mkfs instead of the per file system defaults").PlaceHolder("OPTIONS").String(),
+		mkfsIonice:                 attach.Flag("mkfs-ionice", "Run mkfs in the idle I/O scheduling class (ionice -c3) so it does not starve other processes").Bool(),
+		mkfsTimeout:                attach.Flag("mkfs-timeout", "Kill mkfs if it runs longer than this, 0 for no limit").Default("1h").Duration(),
+		verityRootHash:             attach.Flag("verity-root-hash", "With --read-only, verify the volume with dm-verity against this root hash, the snapshot must have been built with verity metadata").PlaceHolder("HASH").String(),
+		verityHashOffset:           attach.Flag("verity-hash-offset", "Byte offset of the verity hash tree on the volume").PlaceHolder("BYTES").Int64(),
+		thinPool:                   attach.Flag("thin-pool", "Set up an LVM thin pool on the volume and mount a thin volume from it").Bool(),
+		thinVolumeSize:             attach.Flag("thin-volume-size", "Virtual size of the thin volume in GiBs, --create-size when 0").Default("0").Int64(),
+		fsUuid:                     attach.Flag("fs-uuid", "UUID of the created file system").PlaceHolder("UUID").String(),
+		fsUuidOnReuse:              attach.Flag("fs-uuid-on-reuse", "Also set --fs-uuid on the file system of reused and restored volumes").Bool(),
+		verifyFileSystem:           attach.Flag("verify-filesystem", "Check with blkid that reused and restored volumes have a file system and create one if not, use --no-verify-filesystem to skip").Default("true").Bool(),
+		autoResize:                 attach.Flag("auto-resize", "Grow the file system of a reused volume when the volume is larger").Bool(),
+		growFileSystem:             attach.Flag("grow-filesystem", "Grow the file system of a volume restored from a snapshot to the volume size, use --no-grow-filesystem to skip").Default("true").Bool(),
+		reportUsage:                attach.Flag("report-usage", "Log the total, used and free space of the file system after mounting").Default("true").Bool(),
+		createName:                 attach.Flag("create-name", "The name of the created volume, {mount_point} is replaced with the mount point").Required().PlaceHolder("NAME").String(),
+		createVolumeType:           attach.Flag("create-volume-type", "The volume type of the created volume. This can be `gp3` or `gp2` for General Purpose (SSD) volumes, `io1` or `io2` for Provisioned IOPS (SSD) volumes or `standard` for Magnetic volumes").Required().PlaceHolder("TYPE").Enum(volumeTypes...),
+		createIops:                 attach.Flag("create-iops", "Provisioned IOPS of the created volume, required for io1 and io2, 3000 for gp3 when unset").PlaceHolder("IOPS").Int64(),
+		createThroughput:           attach.Flag("create-throughput", "Provisioned throughput in MiB/s of the created gp3 volume, 125 when unset").PlaceHolder("MIBS").Int64(),
+		volumeInitializationRate:   attach.Flag("volume-initialization-rate", "Rate in MiB/s to fully initialize volumes created from a snapshot at, from 100 to 300, lazy loading when unset").PlaceHolder("MIBS").Int64(),
+		multiAttach:                attach.Flag("multi-attach", "Share one multi-attach io1 or io2 volume with a gfs2 or ocfs2 file system between instances, only the first instance creates and formats it").Bool(),
+		clusterWaitTimeout:         attach.Flag("cluster-wait-timeout", "How long --multi-attach waits for the file system another instance creates").Default("10m").Duration(),
+		clusterLockTable:           attach.Flag("cluster-lock-table", "Lock table of gfs2 file systems, the cluster name and a unique file system name").PlaceHolder("CLUSTER:FSNAME").String(),
+		clusterJournals:            attach.Flag("cluster-journals", "Journals of gfs2 and node slots of ocfs2 file systems, the number of instances that can mount it at once").Default("16").Int64(),
+		encrypted:                  attach.Flag("encrypted", "Encrypt created volumes").Bool(),
+		kmsKeyId:                   attach.Flag("kms-key-id", "KMS key to encrypt created volumes with instead of the key of the snapshot or the default EBS key").PlaceHolder("KEY").String(),
+		createTags:                 CreateTags(attach.Flag("create-tags", "Tag to use for the new volume, can be specified multiple times").PlaceHolder("KEY=VALUE")),
+		estimateCost:               attach.Flag("estimate-cost", "Log the estimated monthly cost before creating a volume").Bool(),
+		ensureTags:                 attach.Flag("ensure-tags", "Update the name and create tags of a reused volume to the configured values").Bool(),
+		readinessTag:               Tag(attach.Flag("readiness-tag", "Tag to set on the volume once it is mounted").PlaceHolder("KEY=VALUE")),
+		daemon:                     attach.Flag("daemon", "Keep running after mounting and unmount and detach the volume on SIGTERM or SIGINT").Bool(),
+		snapshotOnExit:             attach.Flag("snapshot-on-exit", "With --daemon, snapshot the volume after unmounting and before detaching it").Bool(),
+		waitForSnapshot:            attach.Flag("wait-for-snapshot", "Wait until the snapshot on exit is completed before detaching").Bool(),
+		credentialCheckInterval:    attach.Flag("credential-check-interval", "With --daemon, how often to check that the AWS credentials still work, 0 disables the check").Default("5m").Duration(),
+		detachOnExit:               attach.Flag("detach-on-exit", "With --daemon, keep the volume on instance termination by clearing DeleteOnTermination before detaching it").Bool(),
+		skipWaitAvailable:          attach.Flag("skip-wait-available", "Attach new empty volumes right away instead of waiting until they are available").Bool(),
+		capacityRetry:              attach.Flag("capacity-retry", "Retry creating the volume while the availability zone has insufficient capacity").Bool(),
+		capacityRetryWindow:        attach.Flag("capacity-retry-window", "How long to retry on insufficient capacity").Default("10m").Duration(),
+		capacityFallbackVolumeType: attach.Flag("capacity-fallback-volume-type", "Volume type to try once the capacity retry window has passed").PlaceHolder("TYPE").Enum(volumeTypes...),
+		deleteOnTermination:        attach.Flag("delete-on-termination", "Delete volume when instance is terminated").Bool(),
+		snapshotName:               attach.Flag("snapshot-name", "Name of snapshot to use for new volume").String(),
+		snapshotTagKey:             attach.Flag("snapshot-tag-key", "The tag key of the snapshot to use for the new volume, Name if not set").PlaceHolder("KEY").String(),
+		snapshotTagValue:           attach.Flag("snapshot-tag-value", "The tag value of the snapshot to use for the new volume").PlaceHolder("VALUE").String(),
+		inheritSnapshotTags:        attach.Flag("inherit-snapshot-tags", "Copy the tags of the snapshot to the new volume, --create-tags take precedence").Bool(),
+		snapshotTags:               TagList(attach.Flag("snapshot-tag", "Tag of snapshots to use for the new volume, tried in order after --snapshot-name, can be specified multiple times").PlaceHolder("KEY=VALUE")),
+		snapshotOwner:              attach.Flag("snapshot-owner", "Only restore snapshots owned by this account, `self` or an account id").Default("self").String(),
+		preferSourceAz:             attach.Flag("prefer-source-az", "Prefer snapshots tagged source-az with the availability zone of the instance over newer ones").Bool(),
+		cloneVolumeId:              attach.Flag("clone-volume-id", "Create the new volume from a fresh snapshot of this volume").PlaceHolder("VOLUME").String(),
+		cloneDeleteSnapshot:        attach.Flag("clone-delete-snapshot", "Delete the snapshot taken by --clone-volume-id once the new volume is available").Bool(),
+		skipIfMounted:              attach.Flag("skip-if-mounted", "Exit successfully if the device is already mounted at the mount point").Bool(),
+		replaceDevice:              attach.Flag("replace-device", "Unmount and detach a different volume attached as the requested device").Bool(),
+		cleanupDangling:            attach.Flag("cleanup-dangling", "Mount a volume with the tag that a previous run left attached as the device instead of failing").Bool(),
+		deviceExistsPolicy:         attach.Flag("device-exists-policy", "What to do if the device already exists: `fail`, `reuse` the volume attached as the device if it has the tag, or `ignore` it").Default("fail").Enum("fail", "reuse", "ignore"),
+		maxRetries:                 global.maxRetries,
+		metadataRetries:            global.metadataRetries,
+		endpointUrl:                global.endpointUrl,
+		region:                     global.region,
+		availabilityZone:           global.availabilityZone,
+		instanceId:                 global.instanceId,
+		operationMaxRetries:        global.operationMaxRetries,
+		logAwsRetries:              global.logAwsRetries,
+		journald:                   global.journald,
+		logFormat:                  global.logFormat,
+		logLevel:                   global.logLevel,
+		statsdAddr:                 attach.Flag("statsd-addr", "Send metrics to this StatsD server").PlaceHolder("HOST:PORT").String(),
+		metricsListen:              attach.Flag("metrics-listen", "Serve Prometheus metrics on /metrics at this address, e.g. :9090").PlaceHolder("ADDR").String(),
+		tagOverwriteProtection:     attach.Flag("create-tags-overwrite-protection", "Never overwrite the value of a tag a volume or snapshot already has").Bool(),
+		apiRateLimit:               global.apiRateLimit,
+		affinityTag:                attach.Flag("affinity-tag", "Only use volumes whose value for this tag matches the instance's").PlaceHolder("KEY").String(),
+		refreshInstanceId:          attach.Flag("refresh-instance-id", "Read the instance id from the instance metadata again right before attaching").Bool(),
+		devicePollInterval:         attach.Flag("device-wait-poll-interval", "Interval between checks for the attached device to appear").Default("500ms").Duration(),
+		useById:                    attach.Flag("use-by-id", "Use the /dev/disk/by-id link of the attached volume for formatting and mounting where available").Bool(),
+	}
+
+	cfg.mountPoint, cfg.bindMountPoints = MountPoints(attach.Flag("mount-point", "Directory where the volume will be mounted, further ones are bind mounts of the first").Required().PlaceHolder("DIR"))
+	return cfg
+}
+
+// exitWithError logs err and exits with the exit code of its failure class.
+func exitWithError(err error, message string) {
+	code := exitCode(err)
+	log.WithFields(log.Fields{"error": err, "exit_code": code}).Error(message)
+	os.Exit(code)
+}
+
+func main() {
+	attach := kingpin.Command("attach", "Create, attach, format and mount a volume").Default()
+	wait := kingpin.Command("wait", "Wait until a volume reaches a state")
+	waitVolumeId := wait.Flag("volume-id", "The volume to wait for").Required().PlaceHolder("VOLUME").String()
+	waitState := wait.Flag("state", "The state to wait for").Required().Enum("available", "in-use")
+	waitTimeout := wait.Flag("timeout", "How long to wait").Default("10m").Duration()
+	probeCommand := kingpin.Command("probe", "Check that a volume is attached and mounted, the exit code tells what failed")
+	probeAttachAs := probeCommand.Flag("attach-as", "device name e.g. xvdb").Required().PlaceHolder("DEVICE").String()
+	probeMountPoint := probeCommand.Flag("mount-point", "Directory where the volume is mounted").Required().PlaceHolder("DIR").String()
+	probeMountNamespace := probeCommand.Flag("mount-namespace", "Look for the mount in the mount namespace of this PID, e.g. 1 for the host when running in a container").PlaceHolder("PID").Int()
+	probeThinPool := probeCommand.Flag("thin-pool", "The volume holds an LVM thin pool and the thin volume on it is mounted").Bool()
+	resizeCommand := kingpin.Command("resize", "Grow an attached and mounted volume and its file system")
+	resizeTagKey := resizeCommand.Flag("tag-key", "The tag key of the attached volume").Required().PlaceHolder("KEY").String()
+	resizeTagValue := resizeCommand.Flag("tag-value", "The tag value of the attached volume").Required().PlaceHolder("VALUE").String()
+	resizeMountPoint := resizeCommand.Flag("mount-point", "Directory where the volume is mounted").Required().PlaceHolder("DIR").String()
+	resizeTo := resizeCommand.Flag("resize-to", "The new size of the volume in GiB").Required().PlaceHolder("SIZE").Int64()
+	resizeTimeout := resizeCommand.Flag("timeout", "How long to wait for the volume modification").Default("30m").Duration()
+	validateCommand := kingpin.Command("validate", "Check that the flags of attach are consistent, without touching AWS, and exit non-zero on any problem")
+
+	global := &Config{
 		maxRetries:          kingpin.Flag("max-retries", "Maximum number of retries for AWS requests").Default("20").Int(),
+		metadataRetries:     kingpin.Flag("metadata-retries", "How often to retry reading the region, availability zone and instance id from the instance metadata").Default("5").Int(),
+		endpointUrl:         kingpin.Flag("endpoint-url", "Send EC2 requests to this endpoint instead of the one of the region, e.g. localstack").PlaceHolder("URL").String(),
+		region:              kingpin.Flag("region", "Use this region instead of the one from the instance metadata").PlaceHolder("REGION").String(),
+		availabilityZone:    kingpin.Flag("availability-zone", "Use this availability zone instead of the one from the instance metadata").PlaceHolder("AZ").String(),
+		instanceId:          kingpin.Flag("instance-id", "Use this instance id instead of the one from the instance metadata").PlaceHolder("INSTANCE").String(),
+		operationMaxRetries: OperationRetries(kingpin.Flag("max-retries-for", "Maximum number of retries for one AWS operation, overriding --max-retries, can be specified multiple times").PlaceHolder("OPERATION=RETRIES")),
+		logAwsRetries:       kingpin.Flag("log-aws-retries", "Log every retry of an AWS request").Bool(),
+		journald:            kingpin.Flag("journald", "Also send log messages with their fields to the systemd journal").Bool(),
+		logFormat:           kingpin.Flag("log-format", "Log as `text` or `json`").Default("text").Enum("text", "json"),
+		logLevel:            kingpin.Flag("log-level", "Only log messages of at least this level: debug, info, warn or error").Default("info").Enum("debug", "info", "warn", "error"),
+		apiRateLimit:        kingpin.Flag("api-rate-limit", "Maximum number of AWS requests per second, 0 for unlimited").Default("0").Float64(),
 	}
+	cfg := attachFlags(attach, global)
+	validateCfg := attachFlags(validateCommand, global)
 
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate)
 	kingpin.CommandLine.Help = "Script to create, attach, format and mount an EBS Volume to an EC2 instance"
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	err := configureLogging(*cfg.logFormat, *cfg.logLevel)
+	if err != nil {
+		exitWithError(wrapError(ErrConfig, err), "Failed to configure logging")
+	}
+
+	if *cfg.journald {
+		hook, err := newJournalHook()
+		if err != nil {
+			exitWithError(wrapError(ErrConfig, err), "Failed to connect to the systemd journal")
+		}
+		log.AddHook(hook)
+	}
 
-	awsAsgEbs := NewAwsAsgEbs(*cfg.maxRetries)
+	if command == wait.FullCommand() {
+		awsAsgEbs, err := newAwsAsgEbsFromConfig(*cfg)
+		if err != nil {
+			exitWithError(err, "Failed to read instance metadata")
+		}
+		err = waitForVolumeState(awsAsgEbs, *waitVolumeId, *waitState, *waitTimeout)
+		if err != nil {
+			exitWithError(wrapError(ErrVolumeNotAvailable, err), "Failed to wait for volume state")
+		}
+		log.WithFields(log.Fields{"volume": *waitVolumeId, "state": *waitState}).Info("Volume reached state")
+		return
+	}
+
+	if command == probeCommand.FullCommand() {
+		awsAsgEbs, err := newAwsAsgEbsFromConfig(*cfg)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "exit_code": probeError}).Error("Probe failed")
+			os.Exit(probeError)
+		}
+		if *probeMountNamespace != 0 {
+			if err := checkMountNamespace(*probeMountNamespace); err != nil {
+				log.WithFields(log.Fields{"error": err, "exit_code": probeError}).Error("Probe failed")
+				os.Exit(probeError)
+			}
+		}
+		awsAsgEbs.MountNamespacePid = *probeMountNamespace
+		code, err := probe(awsAsgEbs, *probeAttachAs, *probeMountPoint, *probeThinPool)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "exit_code": code}).Error("Probe failed")
+			os.Exit(code)
+		}
+		log.WithFields(log.Fields{"device": *probeAttachAs, "mount_point": *probeMountPoint}).Info("Volume is attached and mounted")
+		return
+	}
+
+	if command == resizeCommand.FullCommand() {
+		awsAsgEbs, err := newAwsAsgEbsFromConfig(*cfg)
+		if err != nil {
+			exitWithError(err, "Failed to read instance metadata")
+		}
+		err = resizeVolume(awsAsgEbs, *resizeTagKey, *resizeTagValue, *resizeMountPoint, *resizeTo, *resizeTimeout)
+		if err != nil {
+			exitWithError(wrapError(ErrResizeFailed, err), "Failed to resize volume")
+		}
+		log.WithFields(log.Fields{"mount_point": *resizeMountPoint, "size": *resizeTo}).Info("Volume resized")
+		return
+	}
+
+	if command == validateCommand.FullCommand() {
+		problems := validateConfig(*validateCfg)
+		for _, problem := range problems {
+			log.WithFields(log.Fields{"error": problem}).Error("Invalid configuration")
+		}
+		if len(problems) > 0 {
+			os.Exit(exitCode(ErrConfig))
+		}
+		log.Info("Configuration is valid")
+		return
+	}
+
+	problems := validateConfig(*cfg)
+	if len(problems) > 0 {
+		exitWithError(wrapError(ErrConfig, problems[0]), "Invalid configuration")
+	}
+
+	*cfg.createName = expandCreateName(*cfg.createName, *cfg.mountPoint)
+
+	if *cfg.mountNamespace != 0 {
+		if err := checkMountNamespace(*cfg.mountNamespace); err != nil {
+			exitWithError(wrapError(ErrConfig, err), "Invalid --mount-namespace")
+		}
+	}
+
+	awsAsgEbs, err := newAwsAsgEbsFromConfig(*cfg)
+	if err != nil {
+		exitWithError(err, "Failed to read instance metadata")
+	}
 
-	runAsgEbs(awsAsgEbs, *cfg)
+	if *cfg.statsdAddr != "" {
+		instanceType, err := awsAsgEbs.Metadata.GetMetadata("instance-type")
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Failed to get instance type from instance metadata")
+		}
+		metrics, err = newStatsdClient(*cfg.statsdAddr, map[string]string{"az": awsAsgEbs.AvailabilityZone, "instance_type": instanceType})
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Failed to set up StatsD client, not sending metrics")
+		}
+	}
+
+	awsAsgEbs.DevicePollInterval = *cfg.devicePollInterval
+	awsAsgEbs.RefreshInstanceId = *cfg.refreshInstanceId
+	awsAsgEbs.UseById = *cfg.useById
+	awsAsgEbs.LogCandidates = *cfg.logCandidates
+	switch *cfg.volumeSelection {
+	case "best-fit":
+		awsAsgEbs.BestFitSize = *cfg.createSize
+		awsAsgEbs.VolumeOrder = "oldest"
+	case "oldest", "newest":
+		awsAsgEbs.VolumeOrder = *cfg.volumeSelection
+	}
+	awsAsgEbs.MaxSnapshotSize = *cfg.createSize
+	awsAsgEbs.InheritSnapshotTags = *cfg.inheritSnapshotTags
+	awsAsgEbs.ForceMountPoint = *cfg.forceMountPoint
+	awsAsgEbs.ForceFormat = *cfg.forceFormat
+	awsAsgEbs.ReadOnly = *cfg.readOnly
+	awsAsgEbs.MountRetries = *cfg.mountRetries
+	awsAsgEbs.AttachTimeout = *cfg.attachTimeout
+	awsAsgEbs.CreateIops = *cfg.createIops
+	awsAsgEbs.Encrypted = *cfg.encrypted
+	awsAsgEbs.KmsKeyId = *cfg.kmsKeyId
+	awsAsgEbs.CreateThroughput = *cfg.createThroughput
+	awsAsgEbs.VolumeInitializationRate = *cfg.volumeInitializationRate
+	awsAsgEbs.MultiAttach = *cfg.multiAttach
+	awsAsgEbs.MountProfile = *cfg.mountProfile
+	awsAsgEbs.MountNamespacePid = *cfg.mountNamespace
+	awsAsgEbs.SnapshotOwner = *cfg.snapshotOwner
+	awsAsgEbs.PreferSourceAz = *cfg.preferSourceAz
+	awsAsgEbs.RequireFilesystemTag = *cfg.requireFilesystemTag
+	awsAsgEbs.FilesystemMarkerTag = *cfg.filesystemMarkerTag
+	awsAsgEbs.TagOverwriteProtection = *cfg.tagOverwriteProtection
+
+	if *cfg.autoAttachAs {
+		devices, err := awsAsgEbs.mappedDevices()
+		if err != nil {
+			exitWithError(wrapError(ErrMetadataFailed, err), "Failed to get block device mapping from instance metadata")
+		}
+		attachAs, err := nextFreeDevice(devices)
+		if err != nil {
+			exitWithError(wrapError(ErrPrecondition, err), "Failed to choose device name")
+		}
+		log.WithFields(log.Fields{"device": attachAs, "mapped_devices": devices}).Info("Choosing device name")
+		cfg.attachAs = &attachAs
+	}
+
+	if *cfg.tagValueFromInstanceTag != "" {
+		tagValue, err := awsAsgEbs.describeInstanceTag(*cfg.tagValueFromInstanceTag)
+		if err != nil {
+			exitWithError(wrapError(ErrMetadataFailed, fmt.Errorf("instance tag %s: %w", *cfg.tagValueFromInstanceTag, err)), "Failed to read tag of instance")
+		}
+		if tagValue == nil {
+			exitWithError(wrapError(ErrConfig, fmt.Errorf("instance has no tag %s", *cfg.tagValueFromInstanceTag)), "Instance does not have the tag to take the tag value from")
+		}
+		log.WithFields(log.Fields{"instance_tag": *cfg.tagValueFromInstanceTag, "tag_value": *tagValue}).Info("Setting tag value from instance tag")
+		cfg.tagValue = tagValue
+	}
+
+	if *cfg.affinityTag != "" {
+		affinity, err := awsAsgEbs.describeInstanceTag(*cfg.affinityTag)
+		if err != nil {
+			exitWithError(wrapError(ErrMetadataFailed, fmt.Errorf("affinity tag %s: %w", *cfg.affinityTag, err)), "Failed to read affinity tag of instance")
+		}
+		if affinity == nil {
+			exitWithError(wrapError(ErrConfig, fmt.Errorf("instance has no tag %s", *cfg.affinityTag)), "Instance has no affinity tag")
+		}
+		log.WithFields(log.Fields{"affinity_tag": *cfg.affinityTag, "affinity": *affinity}).Info("Setting volume affinity")
+		awsAsgEbs.AffinityTagKey = *cfg.affinityTag
+		awsAsgEbs.AffinityTagValue = *affinity
+	}
+
+	var asgEbs AsgEbs = awsAsgEbs
+	var metricsServer *http.Server
+	if *cfg.metricsListen != "" {
+		prometheusMetrics = newPrometheusRegistry()
+		metricsServer = startMetricsServer(*cfg.metricsListen, prometheusMetrics)
+		asgEbs = instrumentedAsgEbs{AsgEbs: awsAsgEbs, registry: prometheusMetrics}
+	}
 
+	err = runAsgEbs(asgEbs, *cfg)
+	if err != nil {
+		exitWithError(err, "Failed to provide volume")
+	}
+
+	if *cfg.daemon {
+		err = runDaemon(asgEbs, *cfg)
+		if err != nil {
+			exitWithError(err, "Failed to release volume")
+		}
+	}
+
+	if metricsServer != nil {
+		stopMetricsServer(metricsServer)
+	}
 }
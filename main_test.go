@@ -2,15 +2,26 @@ package main
 
 import (
 	"errors"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
-	defaultVolumeId   = "vol-123456"
-	defaultSnapshotId = "snap-123456"
+	defaultVolumeId         = "vol-123456"
+	defaultSnapshotId       = "snap-123456"
+	defaultAvailabilityZone = "eu-west-1a"
 )
 
 type FakeAsgEbs struct {
@@ -21,10 +32,65 @@ type FakeAsgEbs struct {
 	OnAttachVolume             *mock.Call
 	OnMakeFileSystem           *mock.Call
 	OnMountVolume              *mock.Call
+	VolumeAvailabilityZones    map[string]string
+	DeviceExists               bool
+	NoFileSystem               bool
+	// DeviceMounts are the mounts deviceMounts returns for any device.
+	DeviceMounts []mountInfo
+	// DeviceDir replaces /dev in the paths devicePath returns.
+	DeviceDir string
+}
+
+// fakeEC2 implements the EC2 requests the tests of AwsAsgEbs need, any
+// other request panics.
+type fakeEC2 struct {
+	ec2API
+	volume   *ec2.Volume
+	instance *ec2.Instance
+	tags     []*ec2.Tag
+}
+
+func (fake *fakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{fake.instance}}}}, nil
+}
+
+func (fake *fakeEC2) DescribeVolumes(input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	return &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{fake.volume}}, nil
+}
+
+func (fake *fakeEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	fake.tags = append(fake.tags, input.Tags...)
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// fakeRunner records the commands instead of running them.
+type fakeRunner struct {
+	commands [][]string
+	timeouts []time.Duration
+	// outputs and errors are what Capture returns per command line.
+	outputs map[string]string
+	errors  map[string]error
+}
+
+func (runner *fakeRunner) Run(cmd string, args ...string) error {
+	return runner.RunWithTimeout(0, cmd, args...)
+}
+
+func (runner *fakeRunner) RunWithTimeout(timeout time.Duration, cmd string, args ...string) error {
+	runner.commands = append(runner.commands, append([]string{cmd}, args...))
+	runner.timeouts = append(runner.timeouts, timeout)
+	return nil
+}
+
+func (runner *fakeRunner) Capture(cmd string, args ...string) (string, error) {
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	return runner.outputs[line], runner.errors[line]
 }
 
 func NewFakeAsgEbs(cfg *Config) *FakeAsgEbs {
-	fakeAsgEbs := &FakeAsgEbs{}
+	fakeAsgEbs := &FakeAsgEbs{
+		VolumeAvailabilityZones: map[string]string{},
+	}
 	return fakeAsgEbs
 }
 
@@ -50,6 +116,27 @@ func (fakeAsgEbs *FakeAsgEbs) findSnapshot(tagKey string, tagValue string) (*str
 	}
 }
 
+func (fakeAsgEbs *FakeAsgEbs) createSnapshot(volumeId string, description string, tags map[string]string) (*string, error) {
+	args := fakeAsgEbs.Called(volumeId, description, tags)
+	snap := args.Get(0)
+	switch v := snap.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) waitUntilSnapshotCompleted(snapshotId string) error {
+	args := fakeAsgEbs.Called(snapshotId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deleteSnapshot(snapshotId string) error {
+	args := fakeAsgEbs.Called(snapshotId)
+	return args.Error(0)
+}
+
 func (fakeAsgEbs *FakeAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error) {
 	args := fakeAsgEbs.Called(createSize, createName, createVolumeType, createTags, snapshotId)
 	vol := args.Get(0)
@@ -61,34 +148,235 @@ func (fakeAsgEbs *FakeAsgEbs) createVolume(createSize int64, createName string,
 	}
 }
 
+func (fakeAsgEbs *FakeAsgEbs) ensureTags(volumeId string, tags map[string]string) error {
+	args := fakeAsgEbs.Called(volumeId, tags)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) volumeTags(volumeId string) (map[string]string, error) {
+	args := fakeAsgEbs.Called(volumeId)
+	tags, _ := args.Get(0).(map[string]string)
+	return tags, args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) attachedVolumesSize() (int64, error) {
+	args := fakeAsgEbs.Called()
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) checkMounted(mountPoint string, writable bool) error {
+	args := fakeAsgEbs.Called(mountPoint, writable)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) setReadinessTag(volumeId string, key string, value string) error {
+	args := fakeAsgEbs.Called(volumeId, key, value)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) overlayMount(lowerDir string, volumeMountPoint string, mountPoint string) error {
+	args := fakeAsgEbs.Called(lowerDir, volumeMountPoint, mountPoint)
+	return args.Error(0)
+}
+
 func (fakeAsgEbs *FakeAsgEbs) waitUntilVolumeAvailable(volumeId string) error {
 	args := fakeAsgEbs.Called(volumeId)
 	return args.Error(0)
 }
 
+func (fakeAsgEbs *FakeAsgEbs) waitUntilVolumeInUse(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
 func (fakeAsgEbs *FakeAsgEbs) attachVolume(volumeId string, attachAs string, deleteOnTermination bool) error {
 	args := fakeAsgEbs.Called(volumeId, attachAs, deleteOnTermination)
 	return args.Error(0)
 }
 
-func (fakeAsgEbs *FakeAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error {
-	args := fakeAsgEbs.Called(device, mkfsInodeRatio, volumeId)
+func (fakeAsgEbs *FakeAsgEbs) attachedVolume(attachAs string) (*string, bool, error) {
+	args := fakeAsgEbs.Called(attachAs)
+	vol := args.Get(0)
+	switch v := vol.(type) {
+	case string:
+		return &v, args.Bool(1), args.Error(2)
+	default:
+		return nil, args.Bool(1), args.Error(2)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deviceMounts(device string) ([]mountInfo, error) {
+	return fakeAsgEbs.DeviceMounts, nil
+}
+
+func (fakeAsgEbs *FakeAsgEbs) unmountDevice(device string) error {
+	args := fakeAsgEbs.Called(device)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) unmount(mountPoint string) error {
+	args := fakeAsgEbs.Called(mountPoint)
 	return args.Error(0)
 }
 
+func (fakeAsgEbs *FakeAsgEbs) detachVolume(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) availabilityZone() string {
+	return defaultAvailabilityZone
+}
+
+func (fakeAsgEbs *FakeAsgEbs) volumeAvailabilityZone(volumeId string) (string, error) {
+	if az, ok := fakeAsgEbs.VolumeAvailabilityZones[volumeId]; ok {
+		return az, nil
+	}
+	return defaultAvailabilityZone, nil
+}
+
+func (fakeAsgEbs *FakeAsgEbs) makeFileSystem(device string, mkfs mkfsConfig, volumeId string) error {
+	args := fakeAsgEbs.Called(device, mkfs, volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) setFileSystemUUID(device string, fsType string, uuid string) error {
+	args := fakeAsgEbs.Called(device, fsType, uuid)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) devicePath(volumeId string, attachAs string) string {
+	if fakeAsgEbs.DeviceDir != "" {
+		return filepath.Join(fakeAsgEbs.DeviceDir, attachAs)
+	}
+	return "/dev/" + attachAs
+}
+
+func (fakeAsgEbs *FakeAsgEbs) attachedDevice(attachAs string) (string, error) {
+	return "/dev/" + attachAs, nil
+}
+
 func (fakeAsgEbs *FakeAsgEbs) mountVolume(device string, mountPoint string) error {
 	args := fakeAsgEbs.Called(device, mountPoint)
 	return args.Error(0)
 }
 
+func (fakeAsgEbs *FakeAsgEbs) bindMount(source string, mountPoint string) error {
+	args := fakeAsgEbs.Called(source, mountPoint)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) growFileSystem(device string, mountPoint string) error {
+	args := fakeAsgEbs.Called(device, mountPoint)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) persistMount(device string, mountPoint string) error {
+	args := fakeAsgEbs.Called(device, mountPoint)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) installMountUnit(device string, mountPoint string) error {
+	args := fakeAsgEbs.Called(device, mountPoint)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findAttachedVolume(tagKey string, tagValue string) (*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	volume, _ := args.Get(0).(*ec2.Volume)
+	return volume, args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findClusterVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	volumes, _ := args.Get(0).([]*ec2.Volume)
+	return volumes, args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deleteVolume(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) waitUntilFileSystemCreated(volumeId string, timeout time.Duration) error {
+	args := fakeAsgEbs.Called(volumeId, timeout)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) modifyVolumeSize(volumeId string, size int64) error {
+	args := fakeAsgEbs.Called(volumeId, size)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) waitUntilVolumeModified(volumeId string, timeout time.Duration) error {
+	args := fakeAsgEbs.Called(volumeId, timeout)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) setDeleteOnTermination(volumeId string, attachAs string, deleteOnTermination bool) error {
+	args := fakeAsgEbs.Called(volumeId, attachAs, deleteOnTermination)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) checkCredentials(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) openVerity(device string, volumeId string, rootHash string, hashOffset int64) (string, error) {
+	args := fakeAsgEbs.Called(device, volumeId, rootHash, hashOffset)
+	return args.String(0), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) closeVerity(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deactivateThinPool(volumeGroup string) error {
+	args := fakeAsgEbs.Called(volumeGroup)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deleteTag(volumeId string, key string) error {
+	args := fakeAsgEbs.Called(volumeId, key)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) setupThinPool(device string, volumeId string, create bool, virtualSize int64) (string, error) {
+	args := fakeAsgEbs.Called(device, volumeId, create, virtualSize)
+	return args.String(0), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) hasFileSystem(device string) (bool, error) {
+	return !fakeAsgEbs.NoFileSystem, nil
+}
+
+func (fakeAsgEbs *FakeAsgEbs) fileSystemUsage(mountPoint string) (fileSystemUsage, error) {
+	return fileSystemUsage{}, nil
+}
+
 func (fakeAsgEbs *FakeAsgEbs) checkDevice(device string) error {
+	if fakeAsgEbs.DeviceExists {
+		return errors.New("Device exists")
+	}
 	return nil
 }
 
+func (fakeAsgEbs *FakeAsgEbs) rootDevice() (string, error) {
+	return "/dev/xvda", nil
+}
+
 func (fakeAsgEbs *FakeAsgEbs) checkMountPoint(mountPoint string) error {
 	return nil
 }
 
+func (fakeAsgEbs *FakeAsgEbs) lookupMount(mountPoint string) (*mountInfo, error) {
+	args := fakeAsgEbs.Called(mountPoint)
+	mount, _ := args.Get(0).(*mountInfo)
+	return mount, args.Error(1)
+}
+
 func strPtr(str string) *string {
 	return &str
 }
@@ -101,24 +389,114 @@ func intPtr(i int) *int {
 	return &i
 }
 
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
 func boolPtr(b bool) *bool {
 	return &b
 }
 
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
 func newConfig() *Config {
 	return &Config{
-		tagKey:              strPtr("Name"),
-		tagValue:            strPtr("my-name"),
-		attachAs:            strPtr("xvdc"),
-		mountPoint:          strPtr("/mnt"),
-		createSize:          int64Ptr(200),
-		mkfsInodeRatio:      int64Ptr(4096),
-		createName:          strPtr("my-name"),
-		createVolumeType:    strPtr("gp2"),
-		createTags:          &map[string]string{},
-		deleteOnTermination: boolPtr(true),
-		snapshotName:        strPtr(""),
-		maxRetries:          intPtr(1),
+		tagKey:                     strPtr("Name"),
+		tagValue:                   strPtr("my-name"),
+		tagValueFromInstanceTag:    strPtr(""),
+		fallbackTag:                &TagValue{},
+		noCreate:                   boolPtr(false),
+		volumeSelection:            strPtr("first"),
+		requireFilesystemTag:       boolPtr(true),
+		filesystemMarkerTag:        strPtr("filesystem"),
+		attachAs:                   strPtr("xvdc"),
+		autoAttachAs:               boolPtr(false),
+		allowRootDevice:            boolPtr(false),
+		mountPoint:                 strPtr("/mnt"),
+		bindMountPoints:            &[]string{},
+		forceMountPoint:            boolPtr(false),
+		forceFormat:                boolPtr(false),
+		readOnly:                   boolPtr(false),
+		persistFstab:               boolPtr(false),
+		systemdMount:               boolPtr(false),
+		mountRetries:               intPtr(0),
+		overlayLowerDir:            strPtr(""),
+		overlayVolumeMountPoint:    strPtr(""),
+		attachTimeout:              durationPtr(10 * time.Minute),
+		detachTimeout:              durationPtr(5 * time.Minute),
+		attachRetries:              intPtr(10),
+		attachRetryDelay:           durationPtr(0),
+		mountProfile:               strPtr(""),
+		pauseBeforeMount:           strPtr(""),
+		pauseTimeout:               durationPtr(time.Hour),
+		mountNamespace:             intPtr(0),
+		createSize:                 int64Ptr(200),
+		maxTotalSize:               int64Ptr(0),
+		mkfsInodeRatio:             int64Ptr(4096),
+		filesystemType:             strPtr("ext4"),
+		mkfsBlockSize:              int64Ptr(0),
+		mkfsOptions:                strPtr(""),
+		mkfsIonice:                 boolPtr(false),
+		mkfsTimeout:                durationPtr(time.Hour),
+		thinPool:                   boolPtr(false),
+		verityRootHash:             strPtr(""),
+		verityHashOffset:           int64Ptr(0),
+		thinVolumeSize:             int64Ptr(0),
+		fsUuid:                     strPtr(""),
+		fsUuidOnReuse:              boolPtr(false),
+		verifyFileSystem:           boolPtr(true),
+		autoResize:                 boolPtr(false),
+		growFileSystem:             boolPtr(false),
+		reportUsage:                boolPtr(true),
+		createName:                 strPtr("my-name"),
+		createVolumeType:           strPtr("gp2"),
+		createIops:                 int64Ptr(0),
+		createThroughput:           int64Ptr(0),
+		volumeInitializationRate:   int64Ptr(0),
+		multiAttach:                boolPtr(false),
+		clusterWaitTimeout:         durationPtr(10 * time.Minute),
+		clusterLockTable:           strPtr(""),
+		clusterJournals:            int64Ptr(16),
+		encrypted:                  boolPtr(false),
+		kmsKeyId:                   strPtr(""),
+		createTags:                 &map[string]string{},
+		estimateCost:               boolPtr(false),
+		ensureTags:                 boolPtr(false),
+		readinessTag:               &TagValue{},
+		daemon:                     boolPtr(false),
+		snapshotOnExit:             boolPtr(false),
+		waitForSnapshot:            boolPtr(false),
+		detachOnExit:               boolPtr(false),
+		credentialCheckInterval:    durationPtr(5 * time.Minute),
+		skipWaitAvailable:          boolPtr(false),
+		capacityRetry:              boolPtr(false),
+		capacityRetryWindow:        durationPtr(time.Second),
+		capacityFallbackVolumeType: strPtr(""),
+		deleteOnTermination:        boolPtr(true),
+		snapshotName:               strPtr(""),
+		snapshotTagKey:             strPtr(""),
+		snapshotTagValue:           strPtr(""),
+		inheritSnapshotTags:        boolPtr(false),
+		snapshotTags:               &[]TagValue{},
+		snapshotOwner:              strPtr("self"),
+		preferSourceAz:             boolPtr(false),
+		cloneVolumeId:              strPtr(""),
+		cloneDeleteSnapshot:        boolPtr(false),
+		skipIfMounted:              boolPtr(false),
+		replaceDevice:              boolPtr(false),
+		cleanupDangling:            boolPtr(false),
+		deviceExistsPolicy:         strPtr("fail"),
+		maxRetries:                 intPtr(1),
+		operationMaxRetries:        &map[string]int{},
+		apiRateLimit:               float64Ptr(0),
+		logAwsRetries:              boolPtr(false),
+		tagOverwriteProtection:     boolPtr(false),
+		affinityTag:                strPtr(""),
+		devicePollInterval:         durationPtr(10 * time.Millisecond),
+		useById:                    boolPtr(false),
+		refreshInstanceId:          boolPtr(false),
 	}
 }
 
@@ -139,19 +517,20 @@ func TestCreateVolumeIfNotFound(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("int64"), mock.AnythingOfType("string")).
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("main.mkfsConfig"), mock.AnythingOfType("string")).
 		Return(nil)
 	fakeAsgEbs.
 		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 
-	runAsgEbs(fakeAsgEbs, *cfg)
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
 
 	fakeAsgEbs.AssertCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
 	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
 }
 
@@ -169,12 +548,13 @@ func TestNoVolumeCreationOnFoundVolume(t *testing.T) {
 		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 
-	runAsgEbs(fakeAsgEbs, *cfg)
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
 
 	fakeAsgEbs.AssertCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
 	fakeAsgEbs.AssertNotCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
 }
 
@@ -201,14 +581,49 @@ func TestRetryIfVolumeCouldNotBeAttached(t *testing.T) {
 		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 
-	runAsgEbs(fakeAsgEbs, *cfg)
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
 
 	fakeAsgEbs.AssertNumberOfCalls(t, "findVolume", 2)
 	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 2)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
 }
 
+func TestReadOnlyRefusesNewEmptyVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.readOnly = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
+}
+
+func TestReadOnlyRefusesVolumeWithoutFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.readOnly = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.NoFileSystem = true
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrFormatFailed))
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
+}
+
 func TestCreateVolumeFromSnapshot(t *testing.T) {
 	cfg := newConfig()
 	cfg.snapshotName = strPtr("my-name")
@@ -230,14 +645,15 @@ func TestCreateVolumeFromSnapshot(t *testing.T) {
 		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 
-	runAsgEbs(fakeAsgEbs, *cfg)
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
 
 	fakeAsgEbs.AssertCalled(t, "findSnapshot", "Name", *cfg.snapshotName)
 	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
 	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(defaultSnapshotId))
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
 }
 
@@ -259,19 +675,1312 @@ func TestCreateVolumeWhenSnapshotNotFound(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("int64"), mock.AnythingOfType("string")).
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("main.mkfsConfig"), mock.AnythingOfType("string")).
 		Return(nil)
 	fakeAsgEbs.
 		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 
-	runAsgEbs(fakeAsgEbs, *cfg)
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+	assert.NoError(t, err)
 
 	fakeAsgEbs.AssertCalled(t, "findSnapshot", "Name", *cfg.snapshotName)
 	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
 	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
 }
+
+func TestAttachFailureOnNewVolumeIsReported(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(errors.New("IncorrectState"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrAttachFailed))
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestMountFailureIsReported(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	mountErr := errors.New("exit status 32")
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(mountErr)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrMountFailed))
+	assert.True(t, errors.Is(err, mountErr))
+	assert.False(t, errors.Is(err, ErrAttachFailed))
+}
+
+func TestFilterByAffinity(t *testing.T) {
+	tagged := func(id string, tags map[string]string) *ec2.Volume {
+		volume := &ec2.Volume{VolumeId: aws.String(id)}
+		for k, v := range tags {
+			volume.Tags = append(volume.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		return volume
+	}
+	volumes := []*ec2.Volume{
+		tagged("vol-1", map[string]string{"affinity": "search"}),
+		tagged("vol-2", map[string]string{"Name": "my-name"}),
+		tagged("vol-3", map[string]string{"affinity": "web"}),
+	}
+
+	matching := filterByAffinity(volumes, "affinity", "web")
+
+	assert.Len(t, matching, 1)
+	assert.Equal(t, "vol-3", *matching[0].VolumeId)
+}
+
+func TestWaitForFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "xvdc")
+
+	err := waitForFile(file, 20*time.Millisecond, 5*time.Millisecond)
+	assert.Error(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		os.WriteFile(file, nil, 0644)
+	}()
+	err = waitForFile(file, time.Second, 5*time.Millisecond)
+	assert.NoError(t, err)
+}
+
+func TestSkipIfMountedWithExpectedDevice(t *testing.T) {
+	cfg := newConfig()
+	cfg.skipIfMounted = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("lookupMount", *cfg.mountPoint).
+		Return(&mountInfo{MountPoint: *cfg.mountPoint, Source: filepath.Join("/dev", *cfg.attachAs), FsType: "ext4"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNotCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestSkipIfMountedWithForeignDevice(t *testing.T) {
+	cfg := newConfig()
+	cfg.skipIfMounted = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("lookupMount", *cfg.mountPoint).
+		Return(&mountInfo{MountPoint: *cfg.mountPoint, Source: "fs-1234:/", FsType: "nfs4"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestSkipIfMountedWithThinPool(t *testing.T) {
+	cfg := newConfig()
+	cfg.skipIfMounted = boolPtr(true)
+	cfg.thinPool = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("lookupMount", *cfg.mountPoint).
+		Return(&mountInfo{MountPoint: *cfg.mountPoint, Source: "/dev/mapper/vol--123456-data", FsType: "ext4"}, nil)
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestSkipIfMountedWithOverlay(t *testing.T) {
+	cfg := newConfig()
+	cfg.skipIfMounted = boolPtr(true)
+	cfg.overlayLowerDir = strPtr("/opt/app")
+	cfg.overlayVolumeMountPoint = strPtr("/mnt/overlay-volume")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("lookupMount", *cfg.mountPoint).
+		Return(&mountInfo{MountPoint: *cfg.mountPoint, Source: "overlay", FsType: "overlay"}, nil)
+	fakeAsgEbs.
+		On("lookupMount", *cfg.overlayVolumeMountPoint).
+		Return(&mountInfo{MountPoint: *cfg.overlayVolumeMountPoint, Source: filepath.Join("/dev", *cfg.attachAs), FsType: "ext4"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestSetFileSystemUUIDOnReusedVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsUuid = strPtr("0b1a7b6e-5f3c-4e8a-9d2f-3c4b5a6d7e8f")
+	cfg.fsUuidOnReuse = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("setFileSystemUUID", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "setFileSystemUUID", filepath.Join("/dev", *cfg.attachAs), "ext4", *cfg.fsUuid)
+}
+
+func TestCloneVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.cloneVolumeId = strPtr("vol-source")
+	cfg.cloneDeleteSnapshot = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("createSnapshot", "vol-source", mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("waitUntilSnapshotCompleted", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteSnapshot", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "createSnapshot", "vol-source", mock.AnythingOfType("string"), map[string]string{"clone-source": "vol-source", "mount-point": *cfg.mountPoint})
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(defaultSnapshotId))
+	fakeAsgEbs.AssertCalled(t, "deleteSnapshot", defaultSnapshotId)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestAvailabilityZoneMismatchFailsBeforeAttach(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.VolumeAvailabilityZones[defaultVolumeId] = "eu-west-1b"
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrAttachFailed))
+	assert.Contains(t, err.Error(), "eu-west-1b")
+	assert.Contains(t, err.Error(), defaultAvailabilityZone)
+	fakeAsgEbs.AssertNotCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+}
+
+func TestRetryCreateVolumeOnInsufficientCapacity(t *testing.T) {
+	defer func(delay time.Duration) { capacityRetryDelay = delay }(capacityRetryDelay)
+	capacityRetryDelay = time.Millisecond
+	cfg := newConfig()
+	cfg.capacityRetry = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(nil, awserr.New("InsufficientVolumeCapacity", "There is not enough capacity", nil)).Twice()
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("main.mkfsConfig"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 3)
+}
+
+func TestFallbackVolumeTypeOnInsufficientCapacity(t *testing.T) {
+	defer func(delay time.Duration) { capacityRetryDelay = delay }(capacityRetryDelay)
+	capacityRetryDelay = time.Millisecond
+	cfg := newConfig()
+	cfg.capacityRetry = boolPtr(true)
+	cfg.capacityRetryWindow = durationPtr(0)
+	cfg.capacityFallbackVolumeType = strPtr("standard")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), "gp2", mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(nil, awserr.New("InsufficientVolumeCapacity", "There is not enough capacity", nil))
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), "standard", mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+
+	volumeId, err := createVolumeWithCapacityRetry(fakeAsgEbs, *cfg, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultVolumeId, *volumeId)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 2)
+}
+
+func TestByIdPath(t *testing.T) {
+	assert.Equal(t, "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0", byIdPath("vol-0123456789abcdef0"))
+}
+
+func TestExpectedDevice(t *testing.T) {
+	assert.Equal(t, "/dev/xvdf", expectedDevice("vol-0123456789abcdef0", "sdf", false))
+	assert.Equal(t, "/dev/xvdf", expectedDevice("vol-0123456789abcdef0", "xvdf", false))
+	assert.Equal(t, byIdPath("vol-0123456789abcdef0"), expectedDevice("vol-0123456789abcdef0", "xvdf", true))
+}
+
+func TestResolveNvmeDevice(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "nvme1n1")
+	link := filepath.Join(dir, "nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0")
+	assert.NoError(t, os.WriteFile(device, nil, 0644))
+	assert.NoError(t, os.Symlink("nvme1n1", link))
+
+	assert.Equal(t, device, resolveNvmeDevice(link))
+	assert.Equal(t, filepath.Join(dir, "missing"), resolveNvmeDevice(filepath.Join(dir, "missing")))
+}
+
+func TestIsNitro(t *testing.T) {
+	defer func(file string) { biosVendorFile = file }(biosVendorFile)
+	biosVendorFile = filepath.Join(t.TempDir(), "bios_vendor")
+	assert.False(t, isNitro())
+
+	assert.NoError(t, os.WriteFile(biosVendorFile, []byte("Amazon EC2\n"), 0644))
+	assert.True(t, isNitro())
+
+	assert.NoError(t, os.WriteFile(biosVendorFile, []byte("Xen\n"), 0644))
+	assert.False(t, isNitro())
+
+	assert.NoError(t, os.WriteFile(biosVendorFile, []byte(""), 0644))
+	assert.False(t, isNitro())
+
+	// Reading a directory fails with another error than not existing.
+	biosVendorFile = filepath.Dir(biosVendorFile)
+	assert.False(t, isNitro())
+}
+
+func TestAttachedDevice(t *testing.T) {
+	xen := &AwsAsgEbs{}
+	device, err := xen.attachedDevice("sdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/xvdf", device)
+
+	nitro := &AwsAsgEbs{
+		Nitro:   true,
+		UseById: true,
+		EC2: &fakeEC2{instance: &ec2.Instance{
+			RootDeviceName: aws.String("/dev/xvda"),
+			BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{
+				{DeviceName: aws.String("/dev/xvdf"), Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String(defaultVolumeId)}},
+			},
+		}},
+	}
+	device, err = nitro.attachedDevice("xvdf")
+	assert.NoError(t, err)
+	assert.Equal(t, byIdPath(defaultVolumeId), device)
+
+	device, err = nitro.attachedDevice("xvdg")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/xvdg", device)
+}
+
+func TestReplaceDeviceDetachesConflictingVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.replaceDevice = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return("vol-conflicting", false, nil)
+	fakeAsgEbs.
+		On("unmountDevice", filepath.Join("/dev", *cfg.attachAs)).
+		Return(nil)
+	fakeAsgEbs.
+		On("detachVolume", "vol-conflicting").
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", "vol-conflicting").
+		Return(nil)
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "detachVolume", "vol-conflicting")
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+}
+
+func TestReplaceDeviceRefusesRootVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.replaceDevice = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return("vol-root", true, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+	fakeAsgEbs.AssertNotCalled(t, "unmountDevice", filepath.Join("/dev", *cfg.attachAs))
+	fakeAsgEbs.AssertNotCalled(t, "detachVolume", "vol-root")
+}
+
+func TestRootDeviceIsRejected(t *testing.T) {
+	cfg := newConfig()
+	cfg.attachAs = strPtr("sda1")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestIsRootDevice(t *testing.T) {
+	assert.True(t, isRootDevice("xvda", "/dev/xvda"))
+	assert.True(t, isRootDevice("xvda", "/dev/sda1"))
+	assert.True(t, isRootDevice("/dev/sda", "/dev/xvda"))
+	assert.False(t, isRootDevice("xvdb", "/dev/xvda"))
+	assert.False(t, isRootDevice("xvdaa", "/dev/xvda"))
+}
+
+func TestNextFreeDevice(t *testing.T) {
+	device, err := nextFreeDevice([]string{"sda1", "/dev/xvda", "sdf", "xvdg"})
+	assert.NoError(t, err)
+	assert.Equal(t, "xvdh", device)
+
+	used := []string{}
+	for c := 'f'; c <= 'p'; c++ {
+		used = append(used, "sd"+string(c))
+	}
+	_, err = nextFreeDevice(used)
+	assert.Error(t, err)
+}
+
+func TestFindVolumeInputFilesystemTag(t *testing.T) {
+	hasFilesystemFilter := func(input *ec2.DescribeVolumesInput) bool {
+		for _, filter := range input.Filters {
+			if *filter.Name == "tag:filesystem" {
+				return true
+			}
+		}
+		return false
+	}
+	awsAsgEbs := &AwsAsgEbs{AvailabilityZone: defaultAvailabilityZone, RequireFilesystemTag: true}
+	assert.True(t, hasFilesystemFilter(awsAsgEbs.findVolumeInput("Name", "my-name")))
+
+	awsAsgEbs.RequireFilesystemTag = false
+	assert.False(t, hasFilesystemFilter(awsAsgEbs.findVolumeInput("Name", "my-name")))
+}
+
+func TestFindVolumeInputFilesystemMarkerTag(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{AvailabilityZone: defaultAvailabilityZone, RequireFilesystemTag: true, FilesystemMarkerTag: "asg-ebs-formatted"}
+	input := awsAsgEbs.findVolumeInput("Name", "my-name")
+	assert.Equal(t, "tag:asg-ebs-formatted", *input.Filters[len(input.Filters)-1].Name)
+}
+
+func TestSkipWaitAvailableRetriesAttach(t *testing.T) {
+	defer func(delay time.Duration) { attachPendingDelay = delay }(attachPendingDelay)
+	attachPendingDelay = time.Millisecond
+	cfg := newConfig()
+	cfg.skipWaitAvailable = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(awserr.New("IncorrectState", "vol-123456 is not 'available'.", nil)).Twice()
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("main.mkfsConfig"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 3)
+}
+
+func TestPrepareMountPointWithFileInPlace(t *testing.T) {
+	mountPoint := filepath.Join(t.TempDir(), "data")
+	assert.NoError(t, os.WriteFile(mountPoint, []byte("oops"), 0644))
+
+	err := prepareMountPoint(mountPoint, false)
+	assert.EqualError(t, err, "mount point "+mountPoint+" exists but is not a directory")
+
+	err = prepareMountPoint(mountPoint, true)
+	assert.NoError(t, err)
+	info, err := os.Stat(mountPoint)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestPrepareMountPointWithBrokenSymlink(t *testing.T) {
+	dir := t.TempDir()
+	mountPoint := filepath.Join(dir, "data")
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), mountPoint))
+
+	assert.Error(t, prepareMountPoint(mountPoint, false))
+	assert.NoError(t, prepareMountPoint(mountPoint, true))
+}
+
+func TestBindMountAdditionalMountPoints(t *testing.T) {
+	cfg := newConfig()
+	cfg.bindMountPoints = &[]string{"/srv/data", "/var/lib/app"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("bindMount", *cfg.mountPoint, mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertCalled(t, "bindMount", *cfg.mountPoint, "/srv/data")
+	fakeAsgEbs.AssertCalled(t, "bindMount", *cfg.mountPoint, "/var/lib/app")
+}
+
+func TestValidateMountPoints(t *testing.T) {
+	assert.NoError(t, validateMountPoints([]string{"/mnt", "/srv/data"}))
+	assert.Error(t, validateMountPoints([]string{"/mnt", "/srv/data", "/mnt/"}))
+}
+
+func TestMountPointsValue(t *testing.T) {
+	app := kingpin.New("test", "")
+	mountPoint, bindMountPoints := MountPoints(app.Flag("mount-point", ""))
+
+	_, err := app.Parse([]string{"--mount-point", "/mnt", "--mount-point", "/srv/data", "--mount-point", "/var/lib/app"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "/mnt", *mountPoint)
+	assert.Equal(t, []string{"/srv/data", "/var/lib/app"}, *bindMountPoints)
+}
+
+func TestCandidatesJSON(t *testing.T) {
+	volumes := []*ec2.Volume{
+		{
+			VolumeId:   aws.String(defaultVolumeId),
+			Size:       aws.Int64(200),
+			CreateTime: aws.Time(time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)),
+			Tags:       []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("my-name")}},
+		},
+	}
+
+	assert.Equal(t, `[{"volume_id":"vol-123456","size":200,"create_time":"2016-01-02T03:04:05Z","tags":{"Name":"my-name"}}]`, candidatesJSON(volumes))
+	assert.Equal(t, `[]`, candidatesJSON(nil))
+}
+
+func TestEnsureTagsOnReusedVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.ensureTags = boolPtr(true)
+	cfg.createTags = &map[string]string{"team": "storage"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("ensureTags", defaultVolumeId, mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "ensureTags", defaultVolumeId, map[string]string{"Name": "my-name", "team": "storage"})
+}
+
+func TestAutoResizeOnReusedVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.autoResize = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("growFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(errors.New("resize2fs failed"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrResizeFailed))
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestGrowFileSystemOfRestoredVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.growFileSystem = boolPtr(true)
+	cfg.snapshotName = strPtr("my-name")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findSnapshot", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("growFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestAttachVolumeWithFallbackTag(t *testing.T) {
+	cfg := newConfig()
+	cfg.fallbackTag = &TagValue{Key: "pool", Value: "shared"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", *cfg.tagKey, *cfg.tagValue).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("findVolume", "pool", "shared").
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExpandCreateName(t *testing.T) {
+	assert.Equal(t, "data-var-lib-app", expandCreateName("data-{mount_point}", "/var/lib/app/"))
+	assert.Equal(t, "data-root", expandCreateName("data-{mount_point}", "/"))
+	assert.Equal(t, "my-name", expandCreateName("my-name", "/mnt"))
+}
+
+func TestNoCreateFailsWithoutVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.noCreate = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrVolumeLookupFailed))
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCleanupDanglingMountsRecoveredVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.cleanupDangling = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, "filesystem": "true"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", mock.Anything, mock.Anything)
+	fakeAsgEbs.AssertNotCalled(t, "attachVolume", mock.Anything, mock.Anything, mock.Anything)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+}
+
+func TestCleanupDanglingLeavesUnrelatedVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.cleanupDangling = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: "other"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+}
+
+func TestCleanupDanglingLeavesMountedVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.cleanupDangling = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+	fakeAsgEbs.DeviceMounts = []mountInfo{{MountPoint: "/srv/other", Source: "/dev/" + *cfg.attachAs}}
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, "filesystem": "true"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrPrecondition))
+	fakeAsgEbs.AssertNotCalled(t, "mountVolume", mock.Anything, mock.Anything)
+}
+
+func TestDeviceExistsPolicyReuse(t *testing.T) {
+	cfg := newConfig()
+	cfg.deviceExistsPolicy = strPtr("reuse")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, "filesystem": "true"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "attachVolume", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDeviceExistsPolicyIgnore(t *testing.T) {
+	cfg := newConfig()
+	cfg.deviceExistsPolicy = strPtr("ignore")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, true)
+}
+
+func TestSelectBestFit(t *testing.T) {
+	volumes := []*ec2.Volume{
+		{VolumeId: aws.String("vol-500"), Size: aws.Int64(500)},
+		{VolumeId: aws.String("vol-100"), Size: aws.Int64(100)},
+		{VolumeId: aws.String("vol-250"), Size: aws.Int64(250)},
+		{VolumeId: aws.String("vol-200"), Size: aws.Int64(200)},
+	}
+
+	assert.Equal(t, "vol-200", aws.StringValue(selectBestFit(volumes, 200).VolumeId))
+	assert.Equal(t, "vol-250", aws.StringValue(selectBestFit(volumes, 201).VolumeId))
+	assert.Nil(t, selectBestFit(volumes, 501))
+}
+
+func TestFindSnapshotInputOwner(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{SnapshotOwner: "self"}
+	assert.Equal(t, []*string{aws.String("self")}, awsAsgEbs.findSnapshotInput("Name", "my-snapshot").OwnerIds)
+
+	awsAsgEbs.SnapshotOwner = ""
+	assert.Nil(t, awsAsgEbs.findSnapshotInput("Name", "my-snapshot").OwnerIds)
+}
+
+func TestValidateSnapshotOwner(t *testing.T) {
+	assert.NoError(t, validateSnapshotOwner("self"))
+	assert.NoError(t, validateSnapshotOwner("123456789012"))
+	assert.Error(t, validateSnapshotOwner("amazon"))
+	assert.Error(t, validateSnapshotOwner("1234"))
+}
+
+func TestMountWithRetrySucceededOnPriorAttempt(t *testing.T) {
+	defer func(delay time.Duration) { mountRetryDelay = delay }(mountRetryDelay)
+	mountRetryDelay = time.Millisecond
+	attempts := 0
+	mount := func() error {
+		attempts++
+		return errors.New("mount: timed out")
+	}
+	mounted := func() (bool, error) {
+		return true, nil
+	}
+
+	assert.NoError(t, mountWithRetry(mount, mounted, 3))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestMountWithRetryGivesUp(t *testing.T) {
+	defer func(delay time.Duration) { mountRetryDelay = delay }(mountRetryDelay)
+	mountRetryDelay = time.Millisecond
+	attempts := 0
+	mount := func() error {
+		attempts++
+		return errors.New("mount: timed out")
+	}
+	mounted := func() (bool, error) {
+		return false, nil
+	}
+
+	assert.Error(t, mountWithRetry(mount, mounted, 2))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRestoreFromFallbackSnapshotTag(t *testing.T) {
+	cfg := newConfig()
+	cfg.snapshotName = strPtr("my-name")
+	cfg.snapshotTags = &[]TagValue{{Key: "backup", Value: "daily"}, {Key: "backup", Value: "weekly"}}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findSnapshot", "Name", "my-name").
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("findSnapshot", "backup", "daily").
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findSnapshot", "backup", "weekly")
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(defaultSnapshotId))
+}
+
+func TestFindSnapshotByTagsSkipsTooLargeSnapshots(t *testing.T) {
+	tags := []TagValue{{Key: "backup", Value: "daily"}, {Key: "backup", Value: "weekly"}}
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+
+	fakeAsgEbs.
+		On("findSnapshot", "backup", "daily").
+		Return(nil, errNoFittingSnapshot).Once()
+	fakeAsgEbs.
+		On("findSnapshot", "backup", "weekly").
+		Return(defaultSnapshotId, nil).Once()
+
+	snapshotId, err := findSnapshotByTags(fakeAsgEbs, tags)
+	assert.NoError(t, err)
+	assert.Equal(t, strPtr(defaultSnapshotId), snapshotId)
+
+	fakeAsgEbs.
+		On("findSnapshot", "backup", "daily").
+		Return(nil, errNoFittingSnapshot)
+	fakeAsgEbs.
+		On("findSnapshot", "backup", "weekly").
+		Return(nil, nil)
+
+	snapshotId, err = findSnapshotByTags(fakeAsgEbs, tags)
+	assert.True(t, errors.Is(err, errNoFittingSnapshot))
+	assert.Nil(t, snapshotId)
+}
+
+func TestSnapshotTags(t *testing.T) {
+	cfg := newConfig()
+	cfg.snapshotName = strPtr("my-name")
+	assert.Equal(t, []TagValue{{Key: "Name", Value: "my-name"}}, snapshotTags(*cfg))
+
+	cfg = newConfig()
+	cfg.snapshotTagKey = strPtr("role")
+	cfg.snapshotTagValue = strPtr("database")
+	cfg.snapshotTags = &[]TagValue{{Key: "backup", Value: "daily"}}
+	assert.Equal(t, []TagValue{{Key: "role", Value: "database"}, {Key: "backup", Value: "daily"}}, snapshotTags(*cfg))
+
+	cfg = newConfig()
+	cfg.snapshotTagValue = strPtr("my-name")
+	assert.Equal(t, []TagValue{{Key: "Name", Value: "my-name"}}, snapshotTags(*cfg))
+}
+
+func TestTagListValue(t *testing.T) {
+	app := kingpin.New("test", "")
+	tags := TagList(app.Flag("snapshot-tag", ""))
+
+	_, err := app.Parse([]string{"--snapshot-tag", "backup=daily", "--snapshot-tag", "backup=weekly"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []TagValue{{Key: "backup", Value: "daily"}, {Key: "backup", Value: "weekly"}}, *tags)
+}
+
+func TestThinPoolOnNewVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.thinPool = boolPtr(true)
+	cfg.thinVolumeSize = int64Ptr(1000)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("setupThinPool", "/dev/xvdc", defaultVolumeId, true, int64(1000)).
+		Return("/dev/vol-123456/data", nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("mkfsConfig"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/vol-123456/data", newMkfsConfig(*cfg), defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/vol-123456/data", *cfg.mountPoint)
+}
+
+func TestSelectSnapshotBySourceAz(t *testing.T) {
+	snapshots := []*ec2.Snapshot{
+		{SnapshotId: aws.String("snap-newest"), Tags: []*ec2.Tag{{Key: aws.String("source-az"), Value: aws.String("eu-west-1b")}}},
+		{SnapshotId: aws.String("snap-local"), Tags: []*ec2.Tag{{Key: aws.String("source-az"), Value: aws.String(defaultAvailabilityZone)}}},
+		{SnapshotId: aws.String("snap-oldest")},
+	}
+
+	assert.Equal(t, "snap-local", aws.StringValue(selectSnapshotBySourceAz(snapshots, defaultAvailabilityZone).SnapshotId))
+	assert.Equal(t, "snap-newest", aws.StringValue(selectSnapshotBySourceAz(snapshots, "eu-west-1c").SnapshotId))
+}
+
+func TestSortVolumes(t *testing.T) {
+	oldest := &ec2.Volume{VolumeId: aws.String("vol-oldest"), CreateTime: aws.Time(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))}
+	newest := &ec2.Volume{VolumeId: aws.String("vol-newest"), CreateTime: aws.Time(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC))}
+	middle := &ec2.Volume{VolumeId: aws.String("vol-middle"), CreateTime: aws.Time(time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC))}
+
+	volumes := []*ec2.Volume{middle, newest, oldest}
+	sortVolumes(volumes, "oldest")
+	assert.Equal(t, []*ec2.Volume{oldest, middle, newest}, volumes)
+
+	sortVolumes(volumes, "newest")
+	assert.Equal(t, []*ec2.Volume{newest, middle, oldest}, volumes)
+
+	sortVolumes(volumes, "first")
+	assert.Equal(t, []*ec2.Volume{newest, middle, oldest}, volumes)
+}
+
+func TestSnapshotsFittingSize(t *testing.T) {
+	snapshots := []*ec2.Snapshot{
+		{SnapshotId: aws.String("snap-newest"), VolumeSize: aws.Int64(200)},
+		{SnapshotId: aws.String("snap-fitting"), VolumeSize: aws.Int64(100)},
+		{SnapshotId: aws.String("snap-oldest"), VolumeSize: aws.Int64(50)},
+	}
+
+	fitting := snapshotsFittingSize(snapshots, 100)
+	assert.Len(t, fitting, 2)
+	assert.Equal(t, "snap-fitting", aws.StringValue(fitting[0].SnapshotId))
+	assert.Empty(t, snapshotsFittingSize(snapshots, 10))
+}
+
+func TestPauseBeforeMount(t *testing.T) {
+	cfg := newConfig()
+	cfg.pauseBeforeMount = strPtr(filepath.Join(t.TempDir(), "continue"))
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	assert.NoError(t, os.WriteFile(*cfg.pauseBeforeMount, nil, 0644))
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	_, err = os.Stat(*cfg.pauseBeforeMount)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWaitForSentinelTimeout(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "continue")
+	assert.Error(t, waitForSentinel(file, time.Millisecond, 5*time.Millisecond))
+
+	assert.NoError(t, os.WriteFile(file, nil, 0644))
+	assert.NoError(t, waitForSentinel(file, time.Millisecond, 0))
+}
+
+func TestMaxTotalSizeRejectsNewVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.maxTotalSize = int64Ptr(300)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("attachedVolumesSize").
+		Return(int64(108), nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrCreateFailed))
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	assert.NoError(t, runWithTimeout(time.Second, "/bin/true"))
+
+	err := runWithTimeout(10*time.Millisecond, "/bin/sleep", "1")
+	assert.EqualError(t, err, "/bin/sleep did not finish within 10ms")
+}
+
+func TestCreateFileSystemOnUnformattedReusedVolume(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.NoFileSystem = true
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("mkfsConfig"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), newMkfsConfig(*cfg), defaultVolumeId)
+}
+
+func TestReadinessTagAfterMount(t *testing.T) {
+	cfg := newConfig()
+	cfg.readinessTag = &TagValue{Key: "data-ready", Value: "true"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("checkMounted", *cfg.mountPoint, true).
+		Return(nil)
+	fakeAsgEbs.
+		On("setReadinessTag", defaultVolumeId, "data-ready", "true").
+		Return(errors.New("UnauthorizedOperation"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "setReadinessTag", defaultVolumeId, "data-ready", "true")
+}
+
+func TestReadinessTagClearedWhenMountIsNotUsable(t *testing.T) {
+	cfg := newConfig()
+	cfg.readinessTag = &TagValue{Key: "data-ready", Value: "true"}
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("checkMounted", *cfg.mountPoint, true).
+		Return(errors.New("read-only file system"))
+	fakeAsgEbs.
+		On("deleteTag", defaultVolumeId, "data-ready").
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.True(t, errors.Is(err, ErrMountFailed))
+	fakeAsgEbs.AssertCalled(t, "deleteTag", defaultVolumeId, "data-ready")
+	fakeAsgEbs.AssertNotCalled(t, "setReadinessTag", defaultVolumeId, "data-ready", "true")
+}
+
+func TestCheckMounted(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{}
+
+	assert.Error(t, awsAsgEbs.checkMounted(t.TempDir(), true))
+	// /proc is a mount point that cannot be written to.
+	assert.NoError(t, awsAsgEbs.checkMounted("/proc", false))
+	assert.Error(t, awsAsgEbs.checkMounted("/proc", true))
+}
+
+func TestRunCaptureSeparatesOutput(t *testing.T) {
+	stdout, stderr, err := runCapture(0, "/bin/sh", "-c", "echo out; echo err >&2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", stdout)
+	assert.Equal(t, "err\n", stderr)
+}
+
+func TestOverlayMount(t *testing.T) {
+	cfg := newConfig()
+	cfg.overlayLowerDir = strPtr(t.TempDir())
+	cfg.overlayVolumeMountPoint = strPtr("/mnt/cache-volume")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), "/mnt/cache-volume").
+		Return(nil)
+	fakeAsgEbs.
+		On("overlayMount", *cfg.overlayLowerDir, "/mnt/cache-volume", *cfg.mountPoint).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "overlayMount", *cfg.overlayLowerDir, "/mnt/cache-volume", *cfg.mountPoint)
+}
+
+func TestIsKmsError(t *testing.T) {
+	assert.True(t, isKmsError(awserr.New("KMS.NotFoundException", "Key not found", nil)))
+	assert.True(t, isKmsError(wrapError(ErrCreateFailed, awserr.New("InvalidKMSKey.Id", "Invalid key", nil))))
+	assert.False(t, isKmsError(awserr.New("InsufficientVolumeCapacity", "There is not enough capacity", nil)))
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer log.SetFormatter(&log.TextFormatter{})
+	defer log.SetLevel(log.GetLevel())
+
+	assert.NoError(t, configureLogging("json", "warn"))
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+	assert.IsType(t, &log.JSONFormatter{}, log.StandardLogger().Formatter)
+
+	assert.Error(t, configureLogging("text", "verbose"))
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 2, exitCode(wrapError(ErrMetadataFailed, errors.New("connection refused"))))
+	assert.Equal(t, 7, exitCode(wrapError(ErrAttachFailed, errors.New("VolumeInUse"))))
+	assert.Equal(t, 9, exitCode(wrapError(ErrMountFailed, errors.New("exit status 32"))))
+	assert.Equal(t, 12, exitCode(wrapError(ErrConfig, errors.New("--mount-point is required"))))
+	assert.Equal(t, 1, exitCode(errors.New("unclassified")))
+}
+
+func TestAttachBackoff(t *testing.T) {
+	for attempt, max := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 10: attachRetryMaxDelay} {
+		delay := attachBackoff(2*time.Second, attempt)
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d: %s", attempt, delay)
+	}
+	assert.Equal(t, time.Duration(0), attachBackoff(0, 3))
+}
+
+// blkidNothingFound returns the error of blkid exiting 2, as it does when
+// it finds no signature.
+func blkidNothingFound(t *testing.T) error {
+	err := exec.Command("/bin/sh", "-c", "exit 2").Run()
+	assert.Error(t, err)
+	return err
+}
+
+func TestMakeFileSystem(t *testing.T) {
+	runner := &fakeRunner{errors: map[string]error{"/sbin/blkid -p /dev/xvdf": blkidNothingFound(t)}}
+	client := &fakeEC2{}
+	awsAsgEbs := &AwsAsgEbs{EC2: client, Runner: runner}
+	mkfs := mkfsConfig{fsType: "xfs", timeout: time.Minute}
+
+	assert.NoError(t, awsAsgEbs.makeFileSystem("/dev/xvdf", mkfs, defaultVolumeId))
+
+	assert.Equal(t, [][]string{{"/usr/sbin/mkfs.xfs", "-K", "/dev/xvdf"}}, runner.commands)
+	assert.Equal(t, []time.Duration{time.Minute}, runner.timeouts)
+	tags := map[string]string{}
+	for _, tag := range client.tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	assert.Equal(t, map[string]string{"filesystem": "true", "filesystem-type": "xfs"}, tags)
+}
+
+func TestMakeFileSystemSkipsExistingFileSystem(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{"/sbin/blkid -o value -s TYPE /dev/xvdf": "ext4\n"}}
+	client := &fakeEC2{}
+	awsAsgEbs := &AwsAsgEbs{EC2: client, Runner: runner}
+	mkfs := mkfsConfig{fsType: "xfs", timeout: time.Minute}
+
+	assert.NoError(t, awsAsgEbs.makeFileSystem("/dev/xvdf", mkfs, defaultVolumeId))
+
+	assert.Empty(t, runner.commands)
+	tags := map[string]string{}
+	for _, tag := range client.tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	assert.Equal(t, map[string]string{"filesystem": "true", "filesystem-type": "ext4"}, tags)
+}
+
+func TestMakeFileSystemForceFormat(t *testing.T) {
+	runner := &fakeRunner{}
+	awsAsgEbs := &AwsAsgEbs{EC2: &fakeEC2{}, Runner: runner, ForceFormat: true}
+	mkfs := mkfsConfig{fsType: "xfs", timeout: time.Minute}
+
+	assert.NoError(t, awsAsgEbs.makeFileSystem("/dev/xvdf", mkfs, defaultVolumeId))
+
+	assert.Equal(t, [][]string{{"/usr/sbin/mkfs.xfs", "-K", "/dev/xvdf"}}, runner.commands)
+}
+
+func TestRunMountInNamespace(t *testing.T) {
+	runner := &fakeRunner{}
+	awsAsgEbs := &AwsAsgEbs{Runner: runner, MountNamespacePid: 1}
+
+	assert.NoError(t, awsAsgEbs.runMount("/bin/mount", "/dev/xvdf", "/mnt/data"))
+
+	assert.Equal(t, [][]string{{"/usr/bin/nsenter", "--target", "1", "--mount", "--", "/bin/mount", "/dev/xvdf", "/mnt/data"}}, runner.commands)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// mkfsDefaultOptions are passed to mkfs for each file system type unless
+// they are overridden with --mkfs-options.
+//
+//   - ext4: initialize the inode tables and the journal during mkfs instead
+//     of lazily in the background after the first mount, so I/O performance
+//     right after boot is predictable.
+//   - xfs: skip discarding all blocks during mkfs (-K). Fresh EBS volumes
+//     need no discard and it is slow on thin-provisioned storage.
+var mkfsDefaultOptions = map[string][]string{
+	"ext4": {"-E", "lazy_itable_init=0,lazy_journal_init=0"},
+	"xfs":  {"-K"},
+}
+
+type mkfsConfig struct {
+	fsType     string
+	inodeRatio int64
+	// blockSize is left to mkfs when 0.
+	blockSize int64
+	uuid      string
+	// options replace mkfsDefaultOptions for the file system type when set.
+	options []string
+	// ionice runs mkfs in the idle I/O scheduling class.
+	ionice bool
+	// timeout kills mkfs once it ran this long, 0 for no limit.
+	timeout time.Duration
+	// lockTable and journals configure the cluster file systems, see
+	// clusterFileSystemTypes.
+	lockTable string
+	journals  int64
+}
+
+func newMkfsConfig(cfg Config) mkfsConfig {
+	mkfs := mkfsConfig{
+		fsType:     *cfg.filesystemType,
+		inodeRatio: *cfg.mkfsInodeRatio,
+		blockSize:  *cfg.mkfsBlockSize,
+		uuid:       *cfg.fsUuid,
+		ionice:     *cfg.mkfsIonice,
+		timeout:    *cfg.mkfsTimeout,
+		lockTable:  *cfg.clusterLockTable,
+		journals:   *cfg.clusterJournals,
+	}
+	if *cfg.mkfsOptions != "" {
+		mkfs.options = strings.Fields(*cfg.mkfsOptions)
+	}
+	return mkfs
+}
+
+func mkfsCommand(device string, mkfs mkfsConfig) (string, []string) {
+	args := []string{}
+	switch mkfs.fsType {
+	case "ext2", "ext3", "ext4":
+		args = append(args, "-i", fmt.Sprintf("%d", mkfs.inodeRatio))
+		if mkfs.blockSize != 0 {
+			args = append(args, "-b", fmt.Sprintf("%d", mkfs.blockSize))
+		}
+		if mkfs.uuid != "" {
+			args = append(args, "-U", mkfs.uuid)
+		}
+	case "xfs":
+		if mkfs.blockSize != 0 {
+			args = append(args, "-b", fmt.Sprintf("size=%d", mkfs.blockSize))
+		}
+		if mkfs.uuid != "" {
+			args = append(args, "-m", "uuid="+mkfs.uuid)
+		}
+	case "gfs2":
+		// -O does not ask for confirmation.
+		args = append(args, "-O", "-p", "lock_dlm", "-t", mkfs.lockTable, "-j", fmt.Sprintf("%d", mkfs.journals))
+		if mkfs.blockSize != 0 {
+			args = append(args, "-b", fmt.Sprintf("%d", mkfs.blockSize))
+		}
+	case "ocfs2":
+		args = append(args, "-N", fmt.Sprintf("%d", mkfs.journals))
+		if mkfs.blockSize != 0 {
+			args = append(args, "-b", fmt.Sprintf("%d", mkfs.blockSize))
+		}
+	}
+	if mkfs.options != nil {
+		args = append(args, mkfs.options...)
+	} else {
+		args = append(args, mkfsDefaultOptions[mkfs.fsType]...)
+	}
+	args = append(args, device)
+	cmd := "/usr/sbin/mkfs." + mkfs.fsType
+	if mkfs.ionice {
+		return "/usr/bin/ionice", append([]string{"-c3", cmd}, args...)
+	}
+	return cmd, args
+}
+
+// setUUIDCommand returns the command that changes the UUID of an existing,
+// unmounted file system.
+func setUUIDCommand(device string, fsType string, uuid string) (string, []string) {
+	if fsType == "xfs" {
+		return "/usr/sbin/xfs_admin", []string{"-U", uuid, device}
+	}
+	return "/sbin/tune2fs", []string{"-U", uuid, device}
+}
+
+func validateUUID(uuid string) error {
+	if !uuidPattern.MatchString(uuid) {
+		return fmt.Errorf("invalid file system UUID '%s'", uuid)
+	}
+	return nil
+}
+
+// validateBlockSize checks that size is a power of two that mkfs accepts
+// for the file system type. 0 leaves the block size to mkfs.
+func validateBlockSize(fsType string, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	min, max := int64(1024), int64(65536)
+	switch fsType {
+	case "xfs":
+		min = 512
+	case "gfs2", "ocfs2":
+		min, max = 512, 4096
+	}
+	if size < min || size > max || size&(size-1) != 0 {
+		return fmt.Errorf("invalid %s block size %d, must be a power of two from %d to %d", fsType, size, min, max)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMkfsCommandDefaults(t *testing.T) {
+	cmd, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 16384})
+	assert.Equal(t, "/usr/sbin/mkfs.ext4", cmd)
+	assert.Equal(t, []string{"-i", "16384", "-E", "lazy_itable_init=0,lazy_journal_init=0", "/dev/xvdc"}, args)
+
+	cmd, args = mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "xfs", inodeRatio: 16384})
+	assert.Equal(t, "/usr/sbin/mkfs.xfs", cmd)
+	assert.Equal(t, []string{"-K", "/dev/xvdc"}, args)
+}
+
+func TestMkfsCommandOverriddenOptions(t *testing.T) {
+	_, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 4096, options: []string{"-m", "0"}})
+	assert.Equal(t, []string{"-i", "4096", "-m", "0", "/dev/xvdc"}, args)
+
+	_, args = mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 4096, options: []string{}})
+	assert.Equal(t, []string{"-i", "4096", "/dev/xvdc"}, args)
+}
+
+func TestMkfsCommandWithUUID(t *testing.T) {
+	uuid := "0b1a7b6e-5f3c-4e8a-9d2f-3c4b5a6d7e8f"
+
+	_, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 16384, uuid: uuid, options: []string{}})
+	assert.Equal(t, []string{"-i", "16384", "-U", uuid, "/dev/xvdc"}, args)
+
+	_, args = mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "xfs", uuid: uuid, options: []string{}})
+	assert.Equal(t, []string{"-m", "uuid=" + uuid, "/dev/xvdc"}, args)
+
+	cmd, args := setUUIDCommand("/dev/xvdc", "ext4", uuid)
+	assert.Equal(t, "/sbin/tune2fs", cmd)
+	assert.Equal(t, []string{"-U", uuid, "/dev/xvdc"}, args)
+}
+
+func TestValidateUUID(t *testing.T) {
+	assert.NoError(t, validateUUID("0b1a7b6e-5f3c-4e8a-9d2f-3c4b5a6d7e8f"))
+	assert.Error(t, validateUUID("0b1a7b6e5f3c4e8a9d2f3c4b5a6d7e8f"))
+	assert.Error(t, validateUUID("not-a-uuid"))
+}
+
+func TestMkfsCommandWithIonice(t *testing.T) {
+	cmd, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 4096, options: []string{}, ionice: true})
+	assert.Equal(t, "/usr/bin/ionice", cmd)
+	assert.Equal(t, []string{"-c3", "/usr/sbin/mkfs.ext4", "-i", "4096", "/dev/xvdc"}, args)
+}
+
+func TestMkfsCommandWithBlockSize(t *testing.T) {
+	_, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ext4", inodeRatio: 16384, blockSize: 4096, options: []string{}})
+	assert.Equal(t, []string{"-i", "16384", "-b", "4096", "/dev/xvdc"}, args)
+
+	_, args = mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "xfs", blockSize: 4096, options: []string{}})
+	assert.Equal(t, []string{"-b", "size=4096", "/dev/xvdc"}, args)
+}
+
+func TestValidateBlockSize(t *testing.T) {
+	assert.NoError(t, validateBlockSize("ext4", 0))
+	assert.NoError(t, validateBlockSize("ext4", 4096))
+	assert.NoError(t, validateBlockSize("xfs", 512))
+	assert.Error(t, validateBlockSize("ext4", 512))
+	assert.Error(t, validateBlockSize("ext4", 3000))
+	assert.Error(t, validateBlockSize("xfs", 131072))
+}
+
+func TestNewMkfsConfigFilesystemType(t *testing.T) {
+	cfg := newConfig()
+	cfg.filesystemType = strPtr("xfs")
+
+	cmd, args := mkfsCommand("/dev/xvdc", newMkfsConfig(*cfg))
+	assert.Equal(t, "/usr/sbin/mkfs.xfs", cmd)
+	assert.Equal(t, []string{"-K", "/dev/xvdc"}, args)
+}
+
+func TestMkfsCommandClusterFileSystems(t *testing.T) {
+	cmd, args := mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "gfs2", lockTable: "web:data", journals: 4})
+	assert.Equal(t, "/usr/sbin/mkfs.gfs2", cmd)
+	assert.Equal(t, []string{"-O", "-p", "lock_dlm", "-t", "web:data", "-j", "4", "/dev/xvdc"}, args)
+
+	cmd, args = mkfsCommand("/dev/xvdc", mkfsConfig{fsType: "ocfs2", journals: 4, blockSize: 4096})
+	assert.Equal(t, "/usr/sbin/mkfs.ocfs2", cmd)
+	assert.Equal(t, []string{"-N", "4", "-b", "4096", "/dev/xvdc"}, args)
+}
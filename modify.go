@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The vendored SDK predates elastic volumes, so ModifyVolume and
+// DescribeVolumesModifications are sent with hand written shapes and the API
+// version that introduced them.
+const (
+	opModifyVolume                 = "ModifyVolume"
+	opDescribeVolumesModifications = "DescribeVolumesModifications"
+	modifyVolumeAPIVersion         = "2016-11-15"
+)
+
+var modificationPollInterval = 5 * time.Second
+
+type modifyVolumeInput struct {
+	_ struct{} `type:"structure"`
+
+	VolumeId *string `type:"string" required:"true"`
+	Size     *int64  `type:"integer"`
+}
+
+type volumeModification struct {
+	_ struct{} `type:"structure"`
+
+	VolumeId          *string `locationName:"volumeId" type:"string"`
+	ModificationState *string `locationName:"modificationState" type:"string"`
+	StatusMessage     *string `locationName:"statusMessage" type:"string"`
+	TargetSize        *int64  `locationName:"targetSize" type:"integer"`
+	Progress          *int64  `locationName:"progress" type:"long"`
+}
+
+type modifyVolumeOutput struct {
+	_ struct{} `type:"structure"`
+
+	VolumeModification *volumeModification `locationName:"volumeModification" type:"structure"`
+}
+
+type describeVolumesModificationsInput struct {
+	_ struct{} `type:"structure"`
+
+	VolumeIds []*string `locationName:"VolumeId" locationNameList:"VolumeId" type:"list"`
+}
+
+type describeVolumesModificationsOutput struct {
+	_ struct{} `type:"structure"`
+
+	VolumesModifications []*volumeModification `locationName:"volumeModificationSet" locationNameList:"item" type:"list"`
+}
+
+func newModifyRequest(svc ec2API, name string, input interface{}, output interface{}) *request.Request {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := svc.NewRequest(op, input, output)
+	req.Handlers.Build.PushBack(withQueryParameter("Version", modifyVolumeAPIVersion))
+	return req
+}
+
+// findAttachedVolume returns the volume with the tag that is attached to
+// this instance, or nil if there is none.
+func (awsAsgEbs *AwsAsgEbs) findAttachedVolume(tagKey string, tagValue string) (*ec2.Volume, error) {
+	svc := awsAsgEbs.ec2Client()
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagKey),
+				Values: []*string{aws.String(tagValue)},
+			},
+			{
+				Name:   aws.String("attachment.instance-id"),
+				Values: []*string{aws.String(awsAsgEbs.InstanceId)},
+			},
+		},
+	}
+	describeVolumesOutput, err := svc.DescribeVolumes(describeVolumesInput)
+	if err != nil {
+		return nil, err
+	}
+	if len(describeVolumesOutput.Volumes) == 0 {
+		return nil, nil
+	}
+	return describeVolumesOutput.Volumes[0], nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) modifyVolumeSize(volumeId string, size int64) error {
+	svc := awsAsgEbs.ec2Client()
+
+	input := &modifyVolumeInput{
+		VolumeId: aws.String(volumeId),
+		Size:     aws.Int64(size),
+	}
+	return newModifyRequest(svc, opModifyVolume, input, &modifyVolumeOutput{}).Send()
+}
+
+// waitUntilVolumeModified polls the modification of the volume until it is
+// optimizing, from when on the new size can be used, or completed.
+func (awsAsgEbs *AwsAsgEbs) waitUntilVolumeModified(volumeId string, timeout time.Duration) error {
+	svc := awsAsgEbs.ec2Client()
+	deadline := time.Now().Add(timeout)
+
+	input := &describeVolumesModificationsInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	}
+	for {
+		output := &describeVolumesModificationsOutput{}
+		err := newModifyRequest(svc, opDescribeVolumesModifications, input, output).Send()
+		if err != nil {
+			return err
+		}
+		if len(output.VolumesModifications) == 0 {
+			return fmt.Errorf("no modification of volume %s found", volumeId)
+		}
+		modification := output.VolumesModifications[0]
+		state := aws.StringValue(modification.ModificationState)
+		switch state {
+		case "optimizing", "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("modification of volume %s failed: %s", volumeId, aws.StringValue(modification.StatusMessage))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("modification of volume %s did not finish within %s, state %q", volumeId, timeout, state)
+		}
+		log.WithFields(log.Fields{"volume": volumeId, "state": state, "progress": aws.Int64Value(modification.Progress)}).Debug("Waiting for volume modification")
+		time.Sleep(modificationPollInterval)
+	}
+}
+
+// resizeVolume grows the attached volume with the tag to size GiB and then
+// its file system mounted at mountPoint. EBS volumes cannot shrink.
+func resizeVolume(asgEbs AsgEbs, tagKey string, tagValue string, mountPoint string, size int64, timeout time.Duration) error {
+	volume, err := asgEbs.findAttachedVolume(tagKey, tagValue)
+	if err != nil {
+		return err
+	}
+	if volume == nil || len(volume.Attachments) == 0 {
+		return fmt.Errorf("no volume with tag %s=%s is attached", tagKey, tagValue)
+	}
+	volumeId := aws.StringValue(volume.VolumeId)
+	currentSize := aws.Int64Value(volume.Size)
+	if size < currentSize {
+		return fmt.Errorf("volume %s has %d GiB and cannot shrink to %d GiB", volumeId, currentSize, size)
+	}
+
+	if size == currentSize {
+		log.WithFields(log.Fields{"volume": volumeId, "size": size}).Info("Volume already has the requested size")
+	} else {
+		log.WithFields(log.Fields{"volume": volumeId, "size": currentSize, "target_size": size}).Info("Modifying volume size")
+		err = asgEbs.modifyVolumeSize(volumeId, size)
+		if err != nil {
+			return err
+		}
+		err = asgEbs.waitUntilVolumeModified(volumeId, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	attachAs := strings.TrimPrefix(aws.StringValue(volume.Attachments[0].Device), "/dev/")
+	return asgEbs.growFileSystem(asgEbs.devicePath(volumeId, attachAs), mountPoint)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func attachedVolumeOfSize(size int64) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId:    aws.String(defaultVolumeId),
+		Size:        aws.Int64(size),
+		Attachments: []*ec2.VolumeAttachment{{Device: aws.String("/dev/xvdf")}},
+	}
+}
+
+func TestModifyVolumeRequest(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().WithRegion("eu-west-1")))
+	input := &modifyVolumeInput{
+		VolumeId: aws.String(defaultVolumeId),
+		Size:     aws.Int64(200),
+	}
+	req := newModifyRequest(svc, opModifyVolume, input, &modifyVolumeOutput{})
+
+	assert.NoError(t, req.Build())
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "ModifyVolume", values.Get("Action"))
+	assert.Equal(t, modifyVolumeAPIVersion, values.Get("Version"))
+	assert.Equal(t, defaultVolumeId, values.Get("VolumeId"))
+	assert.Equal(t, "200", values.Get("Size"))
+}
+
+func TestResizeVolume(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("findAttachedVolume", "Name", "data").Return(attachedVolumeOfSize(100), nil)
+	fakeAsgEbs.On("modifyVolumeSize", defaultVolumeId, int64(200)).Return(nil)
+	fakeAsgEbs.On("waitUntilVolumeModified", defaultVolumeId, time.Minute).Return(nil)
+	fakeAsgEbs.On("growFileSystem", "/dev/xvdf", "/mnt/data").Return(nil)
+
+	assert.NoError(t, resizeVolume(fakeAsgEbs, "Name", "data", "/mnt/data", 200, time.Minute))
+	fakeAsgEbs.AssertCalled(t, "modifyVolumeSize", defaultVolumeId, int64(200))
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", "/dev/xvdf", "/mnt/data")
+}
+
+func TestResizeVolumeRefusesToShrink(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("findAttachedVolume", "Name", "data").Return(attachedVolumeOfSize(100), nil)
+
+	err := resizeVolume(fakeAsgEbs, "Name", "data", "/mnt/data", 50, time.Minute)
+
+	assert.EqualError(t, err, "volume vol-123456 has 100 GiB and cannot shrink to 50 GiB")
+	fakeAsgEbs.AssertNotCalled(t, "modifyVolumeSize", mock.Anything, mock.Anything)
+}
+
+func TestResizeVolumeModificationFailed(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("findAttachedVolume", "Name", "data").Return(attachedVolumeOfSize(100), nil)
+	fakeAsgEbs.On("modifyVolumeSize", defaultVolumeId, int64(200)).Return(nil)
+	fakeAsgEbs.On("waitUntilVolumeModified", defaultVolumeId, time.Minute).Return(errors.New("modification failed"))
+
+	assert.Error(t, resizeVolume(fakeAsgEbs, "Name", "data", "/mnt/data", 200, time.Minute))
+	fakeAsgEbs.AssertNotCalled(t, "growFileSystem", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type mountInfo struct {
+	MountPoint string
+	Root       string
+	FsType     string
+	Source     string
+	Options    string
+}
+
+// parseMountInfo parses the format of /proc/self/mountinfo, see proc(5).
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	mounts := []mountInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator == -1 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+		mounts = append(mounts, mountInfo{
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FsType:     fields[separator+1],
+			Source:     unescapeMountInfo(fields[separator+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// unescapeMountInfo decodes the octal escapes (e.g. \040 for a space) the
+// kernel uses for whitespace and backslashes in mountinfo paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readMountInfo(file string) ([]mountInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// findMount returns the topmost mount on exactly mountPoint, or nil.
+func findMount(mounts []mountInfo, mountPoint string) *mountInfo {
+	mountPoint = filepath.Clean(mountPoint)
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == mountPoint {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
+
+// findMountsOfDevice returns all mounts of device, in mount order.
+func findMountsOfDevice(mounts []mountInfo, device string) []mountInfo {
+	found := []mountInfo{}
+	for _, mount := range mounts {
+		if sameDevice(mount.Source, device) {
+			found = append(found, mount)
+		}
+	}
+	return found
+}
+
+// isMountPoint reports whether path is on a different file system than its
+// parent directory.
+func isMountPoint(path string) (bool, error) {
+	path = filepath.Clean(path)
+	if path == "/" {
+		return true, nil
+	}
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(path), &parentStat); err != nil {
+		return false, err
+	}
+	return stat.Dev != parentStat.Dev, nil
+}
+
+// sameDevice reports whether both paths refer to the same device node,
+// following symlinks such as /dev/xvdc -> nvme1n1 where they exist.
+func sameDevice(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	resolvedA, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		return false
+	}
+	resolvedB, err := filepath.EvalSymlinks(b)
+	if err != nil {
+		return false
+	}
+	return resolvedA == resolvedB
+}
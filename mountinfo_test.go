@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sampleMountInfo = `22 28 0:20 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+23 28 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+28 0 202:1 / / rw,relatime shared:1 - ext4 /dev/xvda1 rw,discard,data=ordered
+40 28 0:38 / /mnt rw,relatime shared:20 - nfs4 fs-1234.efs.eu-west-1.amazonaws.com:/ rw,vers=4.1
+41 28 202:32 / /mnt2 rw,relatime shared:21 - ext4 /dev/xvdc rw,data=ordered
+42 28 202:48 / /data\040dir rw,relatime shared:22 - xfs /dev/xvdd rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 6)
+	assert.Equal(t, mountInfo{MountPoint: "/mnt", Root: "/", FsType: "nfs4", Source: "fs-1234.efs.eu-west-1.amazonaws.com:/", Options: "rw,relatime"}, mounts[3])
+	assert.Equal(t, "/data dir", mounts[5].MountPoint)
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	_, err := parseMountInfo(strings.NewReader("22 28 0:20 / /sys rw\n"))
+
+	assert.Error(t, err)
+}
+
+func TestFindMountMatchesExactPath(t *testing.T) {
+	mounts, _ := parseMountInfo(strings.NewReader(sampleMountInfo))
+
+	mount := findMount(mounts, "/mnt/")
+	assert.NotNil(t, mount)
+	assert.Equal(t, "nfs4", mount.FsType)
+
+	// A substring match on /proc/mounts would have reported these as mounted.
+	assert.Nil(t, findMount(mounts, "/mn"))
+	assert.Nil(t, findMount(mounts, "/mnt/data"))
+	assert.Nil(t, findMount(mounts, "/dev/xvdc"))
+
+	assert.Equal(t, "/dev/xvdd", findMount(mounts, "/data dir").Source)
+}
+
+func TestIsMountPoint(t *testing.T) {
+	mounted, err := isMountPoint("/")
+	assert.NoError(t, err)
+	assert.True(t, mounted)
+
+	mounted, err = isMountPoint(t.TempDir())
+	assert.NoError(t, err)
+	assert.False(t, mounted)
+
+	_, err = isMountPoint("/does/not/exist")
+	assert.Error(t, err)
+}
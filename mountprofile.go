@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+)
+
+// mountProfiles are the mount options of each --mount-profile by file
+// system type.
+//
+//   - throughput: fewer, larger log and journal writes for streaming I/O.
+//     xfs: logbsize=256k,largeio,inode64; ext4: noatime,commit=30.
+//   - durability: flush to the volume more often, losing less on a crash.
+//     xfs: wsync; ext4: commit=5,barrier=1,data=ordered.
+//   - latency: avoid metadata writes on reads.
+//     xfs: noatime,inode64; ext4: noatime,nodiratime.
+var mountProfiles = map[string]map[string]string{
+	"throughput": {
+		"xfs":  "logbsize=256k,largeio,inode64",
+		"ext4": "noatime,commit=30",
+	},
+	"durability": {
+		"xfs":  "wsync",
+		"ext4": "commit=5,barrier=1,data=ordered",
+	},
+	"latency": {
+		"xfs":  "noatime,inode64",
+		"ext4": "noatime,nodiratime",
+	},
+}
+
+func mountProfileNames() []string {
+	return []string{"throughput", "durability", "latency"}
+}
+
+func mountProfileOptions(profile string, fsType string) (string, error) {
+	options, ok := mountProfiles[profile][fsType]
+	if !ok {
+		return "", fmt.Errorf("mount profile %s has no options for %s file systems", profile, fsType)
+	}
+	return options, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountProfileOptions(t *testing.T) {
+	options, err := mountProfileOptions("throughput", "xfs")
+	assert.NoError(t, err)
+	assert.Equal(t, "logbsize=256k,largeio,inode64", options)
+
+	_, err = mountProfileOptions("throughput", "btrfs")
+	assert.Error(t, err)
+}
+
+func TestMountProfileNames(t *testing.T) {
+	for _, name := range mountProfileNames() {
+		assert.Contains(t, mountProfiles, name)
+	}
+	assert.Len(t, mountProfiles, len(mountProfileNames()))
+}
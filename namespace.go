@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// With MountNamespacePid set, mounts are made in the mount namespace of
+// that process, e.g. the host's when running in a container. Paths are
+// reached through /proc/PID/root and mount, umount, systemctl and the xfs
+// tools that take a mount point run under nsenter.
+
+func (awsAsgEbs *AwsAsgEbs) mountInfoFile() string {
+	if awsAsgEbs.MountNamespacePid == 0 {
+		return "/proc/self/mountinfo"
+	}
+	return filepath.Join("/proc", strconv.Itoa(awsAsgEbs.MountNamespacePid), "mountinfo")
+}
+
+// hostPath returns where path of the target mount namespace is visible to
+// this process.
+func (awsAsgEbs *AwsAsgEbs) hostPath(path string) string {
+	if awsAsgEbs.MountNamespacePid == 0 {
+		return path
+	}
+	return filepath.Join("/proc", strconv.Itoa(awsAsgEbs.MountNamespacePid), "root", path)
+}
+
+func (awsAsgEbs *AwsAsgEbs) runMount(cmd string, args ...string) error {
+	if awsAsgEbs.MountNamespacePid == 0 {
+		return awsAsgEbs.commandRunner().Run(cmd, args...)
+	}
+	return awsAsgEbs.commandRunner().Run("/usr/bin/nsenter", nsenterArgs(awsAsgEbs.MountNamespacePid, cmd, args...)...)
+}
+
+// captureMount is runMount returning the output of the command, for
+// commands that take a mount point.
+func (awsAsgEbs *AwsAsgEbs) captureMount(cmd string, args ...string) (string, error) {
+	if awsAsgEbs.MountNamespacePid == 0 {
+		return awsAsgEbs.commandRunner().Capture(cmd, args...)
+	}
+	return awsAsgEbs.commandRunner().Capture("/usr/bin/nsenter", nsenterArgs(awsAsgEbs.MountNamespacePid, cmd, args...)...)
+}
+
+func nsenterArgs(pid int, cmd string, args ...string) []string {
+	return append([]string{"--target", strconv.Itoa(pid), "--mount", "--", cmd}, args...)
+}
+
+// checkMountNamespace fails unless the mount namespace of pid can be
+// entered, which needs CAP_SYS_ADMIN and the host PID namespace.
+func checkMountNamespace(pid int) error {
+	namespace := filepath.Join("/proc", strconv.Itoa(pid), "ns", "mnt")
+	if _, err := os.Readlink(namespace); err != nil {
+		return fmt.Errorf("mount namespace of pid %d is not accessible: %w", pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountNamespacePaths(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{}
+	assert.Equal(t, "/proc/self/mountinfo", awsAsgEbs.mountInfoFile())
+	assert.Equal(t, "/mnt", awsAsgEbs.hostPath("/mnt"))
+
+	awsAsgEbs.MountNamespacePid = 1
+	assert.Equal(t, "/proc/1/mountinfo", awsAsgEbs.mountInfoFile())
+	assert.Equal(t, "/proc/1/root/mnt", awsAsgEbs.hostPath("/mnt"))
+}
+
+func TestNsenterArgs(t *testing.T) {
+	assert.Equal(t, []string{"--target", "1", "--mount", "--", "/bin/mount", "/dev/xvdc", "/mnt"}, nsenterArgs(1, "/bin/mount", "/dev/xvdc", "/mnt"))
+}
+
+func TestCheckMountNamespace(t *testing.T) {
+	assert.Error(t, checkMountNamespace(-1))
+}
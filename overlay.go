@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlayOptions returns the mount options of an overlay with the upper and
+// work directories on the volume mounted at volumeMountPoint.
+func overlayOptions(lowerDir string, volumeMountPoint string) string {
+	return strings.Join([]string{
+		"lowerdir=" + lowerDir,
+		"upperdir=" + filepath.Join(volumeMountPoint, "upper"),
+		"workdir=" + filepath.Join(volumeMountPoint, "work"),
+	}, ",")
+}
+
+// checkLowerDir fails unless dir is an existing directory.
+func checkLowerDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// overlayMount mounts lowerDir overlaid with the upper and work directories
+// on the volume at mountPoint. The directories are created on first use.
+func (awsAsgEbs *AwsAsgEbs) overlayMount(lowerDir string, volumeMountPoint string, mountPoint string) error {
+	for _, dir := range []string{"upper", "work"} {
+		err := os.MkdirAll(awsAsgEbs.hostPath(filepath.Join(volumeMountPoint, dir)), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err := prepareMountPoint(awsAsgEbs.hostPath(mountPoint), awsAsgEbs.ForceMountPoint)
+	if err != nil {
+		return err
+	}
+	return awsAsgEbs.runMount("/bin/mount", "-t", "overlay", "overlay", "-o", overlayOptions(lowerDir, volumeMountPoint), mountPoint)
+}
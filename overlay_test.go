@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayOptions(t *testing.T) {
+	assert.Equal(t,
+		"lowerdir=/opt/base,upperdir=/mnt/cache-volume/upper,workdir=/mnt/cache-volume/work",
+		overlayOptions("/opt/base", "/mnt/cache-volume"))
+}
+
+func TestCheckLowerDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0644))
+
+	assert.NoError(t, checkLowerDir(dir))
+	assert.Error(t, checkLowerDir(file))
+	assert.Error(t, checkLowerDir(filepath.Join(dir, "missing")))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Exit codes of the probe command, one per failure class.
+const (
+	probeOk          = 0
+	probeError       = 1
+	probeNotAttached = 2
+	probeNoDevice    = 3
+	probeNotMounted  = 4
+)
+
+// probe checks that a volume is attached as attachAs, its device node
+// exists and the device, or with thinPool the thin volume on it, is mounted
+// exactly at mountPoint. It returns the exit code for the first failed
+// check.
+func probe(asgEbs AsgEbs, attachAs string, mountPoint string, thinPool bool) (int, error) {
+	volumeId, _, err := asgEbs.attachedVolume(attachAs)
+	if err != nil {
+		return probeError, err
+	}
+	if volumeId == nil {
+		return probeNotAttached, fmt.Errorf("no volume attached as %s", attachAs)
+	}
+
+	device := asgEbs.devicePath(*volumeId, attachAs)
+	if _, err := os.Stat(device); err != nil {
+		return probeNoDevice, fmt.Errorf("volume %s is attached but device %s does not exist: %w", *volumeId, device, err)
+	}
+
+	mount, err := asgEbs.lookupMount(mountPoint)
+	if err != nil {
+		return probeError, err
+	}
+	if mount == nil {
+		return probeNotMounted, fmt.Errorf("%s is not mounted", mountPoint)
+	}
+	expected := []string{device}
+	if thinPool {
+		expected = []string{thinVolumeDevice(*volumeId), thinVolumeMapperDevice(*volumeId)}
+	}
+	for _, source := range expected {
+		if sameDevice(mount.Source, source) {
+			return probeOk, nil
+		}
+	}
+	return probeNotMounted, fmt.Errorf("%s is mounted from %s instead of %s", mountPoint, mount.Source, expected[0])
+}
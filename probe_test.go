@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.DeviceDir = t.TempDir()
+	device := filepath.Join(fakeAsgEbs.DeviceDir, "xvdc")
+	assert.NoError(t, os.WriteFile(device, nil, 0644))
+	fakeAsgEbs.On("attachedVolume", "xvdc").Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("lookupMount", "/mnt").Return(&mountInfo{MountPoint: "/mnt", Source: device, FsType: "ext4"}, nil)
+
+	code, err := probe(fakeAsgEbs, "xvdc", "/mnt", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, probeOk, code)
+}
+
+func TestProbeFailures(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("attachedVolume", "xvdc").Return(nil, false, nil)
+
+	code, err := probe(fakeAsgEbs, "xvdc", "/mnt", false)
+	assert.Error(t, err)
+	assert.Equal(t, probeNotAttached, code)
+
+	fakeAsgEbs = NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.DeviceDir = t.TempDir()
+	fakeAsgEbs.On("attachedVolume", "xvdc").Return(defaultVolumeId, false, nil)
+
+	code, _ = probe(fakeAsgEbs, "xvdc", "/mnt", false)
+	assert.Equal(t, probeNoDevice, code)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(fakeAsgEbs.DeviceDir, "xvdc"), nil, 0644))
+	fakeAsgEbs.On("lookupMount", "/mnt").Return(&mountInfo{MountPoint: "/mnt", Source: "/dev/xvdd", FsType: "ext4"}, nil)
+
+	code, _ = probe(fakeAsgEbs, "xvdc", "/mnt", false)
+	assert.Equal(t, probeNotMounted, code)
+}
+
+func TestProbeThinPool(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.DeviceDir = t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(fakeAsgEbs.DeviceDir, "xvdc"), nil, 0644))
+	fakeAsgEbs.On("attachedVolume", "xvdc").Return(defaultVolumeId, false, nil)
+	fakeAsgEbs.On("lookupMount", "/mnt").Return(&mountInfo{MountPoint: "/mnt", Source: thinVolumeMapperDevice(defaultVolumeId), FsType: "ext4"}, nil)
+
+	code, err := probe(fakeAsgEbs, "xvdc", "/mnt", true)
+	assert.NoError(t, err)
+	assert.Equal(t, probeOk, code)
+
+	code, _ = probe(fakeAsgEbs, "xvdc", "/mnt", false)
+	assert.Equal(t, probeNotMounted, code)
+}
+
+func TestLookupMountInMountNamespace(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{MountNamespacePid: os.Getpid()}
+
+	mount, err := awsAsgEbs.lookupMount("/proc")
+	assert.NoError(t, err)
+	assert.Equal(t, "proc", mount.FsType)
+}
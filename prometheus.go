@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// durationBuckets are the upper bounds in seconds of the duration
+// histograms. Creating and attaching volumes takes seconds to minutes.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// prometheusRegistry keeps counters and histograms by name and label set
+// and serves them in the Prometheus text format. Like statsdClient, its
+// methods do nothing on a nil registry.
+type prometheusRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// prometheusMetrics is set in main with --metrics-listen.
+var prometheusMetrics *prometheusRegistry
+
+func newPrometheusRegistry() *prometheusRegistry {
+	return &prometheusRegistry{
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+func labelString(labels map[string]string) string {
+	pairs := []string{}
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (registry *prometheusRegistry) increment(name string, labels map[string]string) {
+	if registry == nil {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.counters[name] == nil {
+		registry.counters[name] = map[string]float64{}
+	}
+	registry.counters[name][labelString(labels)]++
+}
+
+func (registry *prometheusRegistry) observe(name string, labels map[string]string, value float64) {
+	if registry == nil {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.histograms[name] == nil {
+		registry.histograms[name] = map[string]*histogram{}
+	}
+	key := labelString(labels)
+	h := registry.histograms[name][key]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		registry.histograms[name][key] = h
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func sortedStrings(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+// series formats a sample name with its labels and extra labels such as le.
+func series(name string, labels string, extra string) string {
+	all := labels
+	if extra != "" {
+		if all != "" {
+			all += ","
+		}
+		all += extra
+	}
+	if all == "" {
+		return name
+	}
+	return name + "{" + all + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (registry *prometheusRegistry) write(w io.Writer) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	counterNames := []string{}
+	for name := range registry.counters {
+		counterNames = append(counterNames, name)
+	}
+	for _, name := range sortedStrings(counterNames) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		labelSets := []string{}
+		for labels := range registry.counters[name] {
+			labelSets = append(labelSets, labels)
+		}
+		for _, labels := range sortedStrings(labelSets) {
+			fmt.Fprintf(w, "%s %s\n", series(name, labels, ""), formatFloat(registry.counters[name][labels]))
+		}
+	}
+	histogramNames := []string{}
+	for name := range registry.histograms {
+		histogramNames = append(histogramNames, name)
+	}
+	for _, name := range sortedStrings(histogramNames) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		labelSets := []string{}
+		for labels := range registry.histograms[name] {
+			labelSets = append(labelSets, labels)
+		}
+		for _, labels := range sortedStrings(labelSets) {
+			h := registry.histograms[name][labels]
+			for i, bound := range durationBuckets {
+				fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, fmt.Sprintf("le=%q", formatFloat(bound))), h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, `le="+Inf"`), h.count)
+			fmt.Fprintf(w, "%s %s\n", series(name+"_sum", labels, ""), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s %d\n", series(name+"_count", labels, ""), h.count)
+		}
+	}
+}
+
+func (registry *prometheusRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registry.write(w)
+}
+
+// startMetricsServer serves registry on /metrics at addr in the background.
+func startMetricsServer(addr string, registry *prometheusRegistry) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithFields(log.Fields{"error": err, "addr": addr}).Warn("Metrics server failed")
+		}
+	}()
+	log.WithFields(log.Fields{"addr": addr}).Info("Serving Prometheus metrics")
+	return server
+}
+
+func stopMetricsServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Failed to stop metrics server")
+	}
+}
+
+// instrumentedAsgEbs records the duration and result of the slow steps of
+// providing a volume in a prometheusRegistry.
+type instrumentedAsgEbs struct {
+	AsgEbs
+	registry *prometheusRegistry
+}
+
+func (instrumented instrumentedAsgEbs) record(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	instrumented.registry.observe("asg_ebs_operation_duration_seconds", map[string]string{"operation": operation}, time.Since(start).Seconds())
+	instrumented.registry.increment("asg_ebs_operations_total", map[string]string{"operation": operation, "result": result})
+}
+
+func (instrumented instrumentedAsgEbs) findVolume(tagKey string, tagValue string) (*string, error) {
+	start := time.Now()
+	volumeId, err := instrumented.AsgEbs.findVolume(tagKey, tagValue)
+	instrumented.record("findVolume", start, err)
+	return volumeId, err
+}
+
+func (instrumented instrumentedAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error) {
+	start := time.Now()
+	volumeId, err := instrumented.AsgEbs.createVolume(createSize, createName, createVolumeType, createTags, snapshotId)
+	instrumented.record("createVolume", start, err)
+	return volumeId, err
+}
+
+func (instrumented instrumentedAsgEbs) attachVolume(volumeId string, attachAs string, deleteOnTermination bool) error {
+	start := time.Now()
+	err := instrumented.AsgEbs.attachVolume(volumeId, attachAs, deleteOnTermination)
+	instrumented.record("attachVolume", start, err)
+	return err
+}
+
+func (instrumented instrumentedAsgEbs) makeFileSystem(device string, mkfs mkfsConfig, volumeId string) error {
+	start := time.Now()
+	err := instrumented.AsgEbs.makeFileSystem(device, mkfs, volumeId)
+	instrumented.record("makeFileSystem", start, err)
+	return err
+}
+
+func (instrumented instrumentedAsgEbs) mountVolume(device string, mountPoint string) error {
+	start := time.Now()
+	err := instrumented.AsgEbs.mountVolume(device, mountPoint)
+	instrumented.record("mountVolume", start, err)
+	return err
+}
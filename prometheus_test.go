@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPrometheusRegistryWrite(t *testing.T) {
+	registry := newPrometheusRegistry()
+	registry.increment("asg_ebs_attach_retries_total", nil)
+	registry.increment("asg_ebs_attach_retries_total", nil)
+	registry.observe("asg_ebs_operation_duration_seconds", map[string]string{"operation": "attachVolume"}, 7)
+
+	var out bytes.Buffer
+	registry.write(&out)
+
+	assert.Contains(t, out.String(), "# TYPE asg_ebs_attach_retries_total counter\nasg_ebs_attach_retries_total 2\n")
+	assert.Contains(t, out.String(), "# TYPE asg_ebs_operation_duration_seconds histogram\n")
+	assert.Contains(t, out.String(), `asg_ebs_operation_duration_seconds_bucket{operation="attachVolume",le="5"} 0`)
+	assert.Contains(t, out.String(), `asg_ebs_operation_duration_seconds_bucket{operation="attachVolume",le="10"} 1`)
+	assert.Contains(t, out.String(), `asg_ebs_operation_duration_seconds_bucket{operation="attachVolume",le="+Inf"} 1`)
+	assert.Contains(t, out.String(), `asg_ebs_operation_duration_seconds_sum{operation="attachVolume"} 7`)
+}
+
+func TestNilPrometheusRegistry(t *testing.T) {
+	var registry *prometheusRegistry
+	registry.increment("asg_ebs_attach_retries_total", nil)
+	registry.observe("asg_ebs_operation_duration_seconds", nil, 1)
+}
+
+func TestInstrumentedAsgEbsRecordsResult(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("attachVolume", defaultVolumeId, "xvdf", false).Return(errors.New("VolumeInUse"))
+	registry := newPrometheusRegistry()
+	instrumented := instrumentedAsgEbs{AsgEbs: fakeAsgEbs, registry: registry}
+
+	assert.Error(t, instrumented.attachVolume(defaultVolumeId, "xvdf", false))
+
+	assert.Equal(t, 1.0, registry.counters["asg_ebs_operations_total"][`operation="attachVolume",result="failure"`])
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, "xvdf", mock.Anything)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(2)
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+
+	// The initial burst is not delayed.
+	assert.Equal(t, time.Duration(0), limiter.reserve())
+	assert.Equal(t, time.Duration(0), limiter.reserve())
+
+	// Further requests are spaced out at the configured rate.
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve())
+	assert.Equal(t, time.Second, limiter.reserve())
+
+	now = now.Add(3 * time.Second)
+	assert.Equal(t, time.Duration(0), limiter.reserve())
+}
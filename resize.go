@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	dumpe2fsBlockCountPattern = regexp.MustCompile(`(?m)^Block count:\s+(\d+)$`)
+	dumpe2fsBlockSizePattern  = regexp.MustCompile(`(?m)^Block size:\s+(\d+)$`)
+	xfsInfoDataPattern        = regexp.MustCompile(`(?m)^data\s+=\s+bsize=(\d+)\s+blocks=(\d+)`)
+)
+
+// blockDeviceSize returns the size of device in bytes. The sysfs size is
+// always in 512 byte sectors, independent of the logical block size.
+func blockDeviceSize(device string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+	content, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(resolved), "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return sectors * 512, nil
+}
+
+func parseDumpe2fs(out string) (int64, error) {
+	count := dumpe2fsBlockCountPattern.FindStringSubmatch(out)
+	size := dumpe2fsBlockSizePattern.FindStringSubmatch(out)
+	if count == nil || size == nil {
+		return 0, fmt.Errorf("no block count in dumpe2fs output")
+	}
+	blocks, _ := strconv.ParseInt(count[1], 10, 64)
+	blockSize, _ := strconv.ParseInt(size[1], 10, 64)
+	return blocks * blockSize, nil
+}
+
+func parseXfsInfo(out string) (int64, error) {
+	data := xfsInfoDataPattern.FindStringSubmatch(out)
+	if data == nil {
+		return 0, fmt.Errorf("no data section in xfs_info output")
+	}
+	blockSize, _ := strconv.ParseInt(data[1], 10, 64)
+	blocks, _ := strconv.ParseInt(data[2], 10, 64)
+	return blocks * blockSize, nil
+}
+
+// fileSystemSize returns the size of the mounted file system as recorded in
+// its superblock. statfs is not used as it leaves out the metadata overhead.
+func (awsAsgEbs *AwsAsgEbs) fileSystemSize(device string, mountPoint string, fsType string) (int64, error) {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		out, err := awsAsgEbs.commandRunner().Capture("/sbin/dumpe2fs", "-h", device)
+		if err != nil {
+			return 0, err
+		}
+		return parseDumpe2fs(out)
+	case "xfs":
+		out, err := awsAsgEbs.captureMount("/usr/sbin/xfs_info", mountPoint)
+		if err != nil {
+			return 0, err
+		}
+		return parseXfsInfo(out)
+	}
+	return 0, fmt.Errorf("resizing %s file systems is not supported", fsType)
+}
+
+// canGrow returns whether asg-ebs knows how to grow file systems of fsType.
+func canGrow(fsType string) bool {
+	switch fsType {
+	case "ext2", "ext3", "ext4", "xfs":
+		return true
+	}
+	return false
+}
+
+// growCommand returns the command that grows a mounted file system to the
+// size of its device.
+func growCommand(device string, mountPoint string, fsType string) (string, []string) {
+	if fsType == "xfs" {
+		return "/usr/sbin/xfs_growfs", []string{mountPoint}
+	}
+	return "/sbin/resize2fs", []string{device}
+}
+
+// growFileSystem grows the file system mounted at mountPoint when the device
+// is larger, e.g. after the volume was modified outside of asg-ebs. Other
+// file system types than ext and xfs are left as they are.
+func (awsAsgEbs *AwsAsgEbs) growFileSystem(device string, mountPoint string) error {
+	mounts, err := readMountInfo(awsAsgEbs.mountInfoFile())
+	if err != nil {
+		return err
+	}
+	mount := findMount(mounts, mountPoint)
+	if mount == nil {
+		return fmt.Errorf("%s is not mounted", mountPoint)
+	}
+	if !canGrow(mount.FsType) {
+		log.WithFields(log.Fields{"device": device, "mount_point": mountPoint, "fs_type": mount.FsType}).Warn("Growing this file system type is not supported, skipping")
+		return nil
+	}
+	deviceSize, err := blockDeviceSize(device)
+	if err != nil {
+		return err
+	}
+	fsSize, err := awsAsgEbs.fileSystemSize(device, mountPoint, mount.FsType)
+	if err != nil {
+		return err
+	}
+	if fsSize >= deviceSize {
+		log.WithFields(log.Fields{"device": device, "size": deviceSize}).Info("File system already spans the device")
+		return nil
+	}
+
+	log.WithFields(log.Fields{"device": device, "device_size": deviceSize, "fs_size": fsSize}).Info("File system is smaller than the device, growing it")
+	cmd, args := growCommand(device, mountPoint, mount.FsType)
+	// xfs_growfs takes the mount point, which is in the mount namespace.
+	if mount.FsType == "xfs" {
+		return awsAsgEbs.runMount(cmd, args...)
+	}
+	return awsAsgEbs.commandRunner().Run(cmd, args...)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDumpe2fs(t *testing.T) {
+	out := `Filesystem volume name:   <none>
+Block count:              52428800
+Reserved block count:     2621440
+Block size:               4096
+`
+	size, err := parseDumpe2fs(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(214748364800), size)
+
+	_, err = parseDumpe2fs("")
+	assert.Error(t, err)
+}
+
+func TestParseXfsInfo(t *testing.T) {
+	out := `meta-data=/dev/xvdc              isize=512    agcount=4, agsize=13107200 blks
+         =                       sectsz=512   attr=2, projid32bit=1
+data     =                       bsize=4096   blocks=52428800, imaxpct=25
+naming   =version 2              bsize=4096   ascii-ci=0, ftype=1
+log      =internal log           bsize=4096   blocks=25600, version=2
+`
+	size, err := parseXfsInfo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(214748364800), size)
+}
+
+func TestGrowCommand(t *testing.T) {
+	cmd, args := growCommand("/dev/xvdc", "/mnt", "ext4")
+	assert.Equal(t, "/sbin/resize2fs", cmd)
+	assert.Equal(t, []string{"/dev/xvdc"}, args)
+
+	cmd, args = growCommand("/dev/xvdc", "/mnt", "xfs")
+	assert.Equal(t, "/usr/sbin/xfs_growfs", cmd)
+	assert.Equal(t, []string{"/mnt"}, args)
+}
+
+func TestFileSystemSizeInMountNamespace(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"/usr/bin/nsenter --target 1 --mount -- /usr/sbin/xfs_info /mnt": "data     =                       bsize=4096   blocks=1024, imaxpct=25\n",
+		"/sbin/dumpe2fs -h /dev/xvdc":                                    "Block count:              2048\nBlock size:               1024\n",
+	}}
+	awsAsgEbs := &AwsAsgEbs{Runner: runner, MountNamespacePid: 1}
+
+	size, err := awsAsgEbs.fileSystemSize("/dev/xvdc", "/mnt", "xfs")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4194304), size)
+
+	size, err = awsAsgEbs.fileSystemSize("/dev/xvdc", "/mnt", "ext4")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2097152), size)
+}
+
+func TestGrowFileSystemSkipsUnsupportedType(t *testing.T) {
+	runner := &fakeRunner{}
+	awsAsgEbs := &AwsAsgEbs{Runner: runner}
+
+	// /proc is mounted everywhere and has no device to compare with.
+	assert.NoError(t, awsAsgEbs.growFileSystem("/dev/none", "/proc"))
+	assert.Empty(t, runner.commands)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// operationRetries overrides --max-retries for single AWS operations, by
+// operation name such as DescribeVolumes or CreateVolume.
+type operationRetries map[string]int
+
+// apply is a Build handler. It replaces the retryer of the client, which
+// uses --max-retries, for the operations with an override.
+func (retries operationRetries) apply(r *request.Request) {
+	if maxRetries, ok := retries[r.Operation.Name]; ok {
+		r.Retryer = client.DefaultRetryer{NumMaxRetries: maxRetries}
+	}
+}
+
+// isEC2Operation reports whether name is an EC2 operation of the vendored
+// SDK, which has a NameRequest method for each, or one asg-ebs sends with
+// hand written shapes.
+func isEC2Operation(name string) bool {
+	if name == opModifyVolume || name == opDescribeVolumesModifications {
+		return true
+	}
+	_, ok := reflect.TypeOf((*ec2iface.EC2API)(nil)).Elem().MethodByName(name + "Request")
+	return ok
+}
+
+type OperationRetriesValue map[string]int
+
+func (v OperationRetriesValue) Set(str string) error {
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected OPERATION=RETRIES got '%s'", str)
+	}
+	if !isEC2Operation(parts[0]) {
+		return fmt.Errorf("unknown EC2 operation '%s'", parts[0])
+	}
+	retries, err := strconv.Atoi(parts[1])
+	if err != nil || retries < 0 {
+		return fmt.Errorf("invalid number of retries '%s'", parts[1])
+	}
+	v[parts[0]] = retries
+	return nil
+}
+
+func (v OperationRetriesValue) String() string {
+	return ""
+}
+
+func OperationRetries(s kingpin.Settings) (target *map[string]int) {
+	target = &map[string]int{}
+	s.SetValue((*OperationRetriesValue)(target))
+	return
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestOperationRetriesApply(t *testing.T) {
+	retries := operationRetries{"CreateVolume": 1}
+
+	r := &request.Request{Operation: &request.Operation{Name: "CreateVolume"}, Retryer: client.DefaultRetryer{NumMaxRetries: 20}}
+	retries.apply(r)
+	assert.Equal(t, 1, r.MaxRetries())
+
+	r = &request.Request{Operation: &request.Operation{Name: "DescribeVolumes"}, Retryer: client.DefaultRetryer{NumMaxRetries: 20}}
+	retries.apply(r)
+	assert.Equal(t, 20, r.MaxRetries())
+}
+
+func TestOperationRetriesValue(t *testing.T) {
+	app := kingpin.New("test", "")
+	retries := OperationRetries(app.Flag("max-retries-for", ""))
+
+	_, err := app.Parse([]string{"--max-retries-for", "CreateVolume=1", "--max-retries-for", "DescribeVolumes=50"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"CreateVolume": 1, "DescribeVolumes": 50}, *retries)
+
+	_, err = app.Parse([]string{"--max-retries-for", "CreateVolume=many"})
+	assert.Error(t, err)
+
+	_, err = app.Parse([]string{"--max-retries-for", "CreateVolumes=1"})
+	assert.Error(t, err)
+}
+
+func TestIsEC2Operation(t *testing.T) {
+	assert.True(t, isEC2Operation("DescribeVolumes"))
+	assert.True(t, isEC2Operation("ModifyVolume"))
+	assert.False(t, isEC2Operation("DescribeVolumesPages"))
+	assert.False(t, isEC2Operation("CreateVolumeRequest"))
+	assert.False(t, isEC2Operation("describevolumes"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// statsdClient sends metrics over UDP in the StatsD format with DogStatsD
+// tags. Sending never blocks the run and failures are only logged. Its
+// methods do nothing on a nil client, so metrics can be reported
+// unconditionally.
+type statsdClient struct {
+	conn net.Conn
+	tags []string
+}
+
+// metrics is set in main with --statsd-addr.
+var metrics *statsdClient
+
+func newStatsdClient(addr string, tags map[string]string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tagList := []string{}
+	for k, v := range tags {
+		tagList = append(tagList, k+":"+v)
+	}
+	sort.Strings(tagList)
+	return &statsdClient{conn: conn, tags: tagList}, nil
+}
+
+func statsdLine(name string, value string, metricType string, tags []string) string {
+	line := fmt.Sprintf("asg_ebs.%s:%s|%s", name, value, metricType)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func (client *statsdClient) send(line string) {
+	if client == nil {
+		return
+	}
+	_, err := client.conn.Write([]byte(line))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Failed to send metric")
+	}
+}
+
+func (client *statsdClient) increment(name string) {
+	if client == nil {
+		return
+	}
+	client.send(statsdLine(name, "1", "c", client.tags))
+}
+
+func (client *statsdClient) timing(name string, d time.Duration) {
+	if client == nil {
+		return
+	}
+	client.send(statsdLine(name, fmt.Sprintf("%d", d.Milliseconds()), "ms", client.tags))
+}
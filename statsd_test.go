@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdLine(t *testing.T) {
+	assert.Equal(t, "asg_ebs.volumes.created:1|c", statsdLine("volumes.created", "1", "c", nil))
+	assert.Equal(t, "asg_ebs.attach.duration:1500|ms|#az:eu-west-1a,instance_type:m4.large", statsdLine("attach.duration", "1500", "ms", []string{"az:eu-west-1a", "instance_type:m4.large"}))
+}
+
+func TestStatsdClient(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	client, err := newStatsdClient(server.LocalAddr().String(), map[string]string{"az": defaultAvailabilityZone})
+	assert.NoError(t, err)
+	client.timing("attach.duration", 2*time.Second)
+
+	buf := make([]byte, 512)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "asg_ebs.attach.duration:2000|ms|#az:eu-west-1a", string(buf[:n]))
+
+	var nilClient *statsdClient
+	nilClient.increment("volumes.created")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	systemdRuntimeDir = "/run/systemd/system"
+	systemdUnitDir    = "/etc/systemd/system"
+)
+
+// systemdEscapePath escapes path like systemd-escape --path, e.g.
+// /mnt/my-data becomes mnt-my\x2ddata.
+func systemdEscapePath(path string) string {
+	parts := []string{}
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+
+	var escaped strings.Builder
+	for i, c := range []byte(strings.Join(parts, "/")) {
+		switch {
+		case c == '/':
+			escaped.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		}
+	}
+	return escaped.String()
+}
+
+// mountUnitName returns the name systemd requires for the mount unit of
+// mountPoint.
+func mountUnitName(mountPoint string) string {
+	return systemdEscapePath(mountPoint) + ".mount"
+}
+
+// mountUnit returns the mount unit mounting the file system with uuid. Like
+// the fstab entry it is nofail, so booting does not block when the volume
+// is gone.
+func mountUnit(uuid string, mountPoint string, fsType string, options []string) string {
+	options = append([]string{"defaults"}, options...)
+	options = append(options, "nofail")
+	return fmt.Sprintf(`[Unit]
+Description=asg-ebs volume at %s
+
+[Mount]
+What=/dev/disk/by-uuid/%s
+Where=%s
+Type=%s
+Options=%s
+
+[Install]
+WantedBy=multi-user.target
+`, mountPoint, uuid, mountPoint, fsType, strings.Join(options, ","))
+}
+
+// installMountUnit writes a mount unit for the mount of device at
+// mountPoint and enables it, so services can declare RequiresMountsFor on
+// it. Without systemd it does nothing.
+func (awsAsgEbs *AwsAsgEbs) installMountUnit(device string, mountPoint string) error {
+	if _, err := os.Stat(awsAsgEbs.hostPath(systemdRuntimeDir)); err != nil {
+		log.WithFields(log.Fields{"mount_point": mountPoint}).Info("systemd is not running, not installing mount unit")
+		return nil
+	}
+
+	uuid, err := awsAsgEbs.fileSystemUUID(device)
+	if err != nil {
+		return err
+	}
+	fsType, err := awsAsgEbs.fileSystemType(device)
+	if err != nil {
+		return err
+	}
+	options, err := awsAsgEbs.mountOptions(device)
+	if err != nil {
+		return err
+	}
+
+	name := mountUnitName(mountPoint)
+	path := filepath.Join(awsAsgEbs.hostPath(systemdUnitDir), name)
+	log.WithFields(log.Fields{"unit": name, "path": path}).Info("Installing mount unit")
+	err = os.WriteFile(path, []byte(mountUnit(uuid, mountPoint, fsType, options)), 0644)
+	if err != nil {
+		return err
+	}
+
+	// The unit belongs to the systemd of the mount namespace.
+	err = awsAsgEbs.runMount("/bin/systemctl", "daemon-reload")
+	if err != nil {
+		return err
+	}
+	return awsAsgEbs.runMount("/bin/systemctl", "enable", "--now", name)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountUnitName(t *testing.T) {
+	assert.Equal(t, "mnt-data.mount", mountUnitName("/mnt/data"))
+	assert.Equal(t, "mnt-data.mount", mountUnitName("//mnt//data/"))
+	assert.Equal(t, `mnt-my\x2ddata.mount`, mountUnitName("/mnt/my-data"))
+	assert.Equal(t, "var-lib-.docker.mount", mountUnitName("/var/lib/.docker"))
+	assert.Equal(t, `\x2edata.mount`, mountUnitName("/.data"))
+	assert.Equal(t, "-.mount", mountUnitName("/"))
+}
+
+func TestMountUnit(t *testing.T) {
+	unit := mountUnit("1234", "/mnt/data", "xfs", []string{"ro"})
+
+	assert.Contains(t, unit, "What=/dev/disk/by-uuid/1234\n")
+	assert.Contains(t, unit, "Where=/mnt/data\n")
+	assert.Contains(t, unit, "Type=xfs\n")
+	assert.Contains(t, unit, "Options=defaults,ro,nofail\n")
+}
+
+func TestInstallMountUnit(t *testing.T) {
+	defer func(runtimeDir string, unitDir string) {
+		systemdRuntimeDir, systemdUnitDir = runtimeDir, unitDir
+	}(systemdRuntimeDir, systemdUnitDir)
+	systemdRuntimeDir = t.TempDir()
+	systemdUnitDir = t.TempDir()
+
+	// The mount namespace of this process maps every path to itself.
+	pid := os.Getpid()
+	runner := &fakeRunner{outputs: map[string]string{
+		"/sbin/blkid -o value -s UUID /dev/xvdf": "1234\n",
+		"/sbin/blkid -o value -s TYPE /dev/xvdf": "xfs\n",
+	}}
+	awsAsgEbs := &AwsAsgEbs{Runner: runner, MountNamespacePid: pid}
+
+	assert.NoError(t, awsAsgEbs.installMountUnit("/dev/xvdf", "/mnt/data"))
+
+	unit, err := os.ReadFile(filepath.Join(systemdUnitDir, "mnt-data.mount"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountUnit("1234", "/mnt/data", "xfs", []string{}), string(unit))
+	nsenter := []string{"/usr/bin/nsenter", "--target", strconv.Itoa(pid), "--mount", "--"}
+	assert.Equal(t, [][]string{
+		append(nsenter, "/bin/systemctl", "daemon-reload"),
+		append(nsenter, "/bin/systemctl", "enable", "--now", "mnt-data.mount"),
+	}, runner.commands)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func toEc2Tags(tags map[string]string) []*ec2.Tag {
+	ec2Tags := []*ec2.Tag{}
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags,
+			&ec2.Tag{
+				Key:   aws.String(k),
+				Value: aws.String(v),
+			},
+		)
+	}
+	return ec2Tags
+}
+
+func describeResourceTags(svc ec2API, resourceId string) (map[string]string, error) {
+	describeTagsInput := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("resource-id"),
+				Values: []*string{
+					aws.String(resourceId),
+				},
+			},
+		},
+	}
+	tags := map[string]string{}
+	err := svc.DescribeTagsPages(describeTagsInput, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, tag := range page.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return true
+	})
+	return tags, err
+}
+
+// withoutExistingTags splits tags into those whose key is not in existing
+// and the keys that are.
+func withoutExistingTags(tags []*ec2.Tag, existing map[string]string) ([]*ec2.Tag, []string) {
+	missing := []*ec2.Tag{}
+	skipped := []string{}
+	for _, tag := range tags {
+		if _, ok := existing[aws.StringValue(tag.Key)]; ok {
+			skipped = append(skipped, aws.StringValue(tag.Key))
+			continue
+		}
+		missing = append(missing, tag)
+	}
+	return missing, skipped
+}
+
+// createTags tags the resource. With TagOverwriteProtection, tags whose key
+// the resource already has are skipped, so values set by other tooling are
+// never overwritten.
+func (awsAsgEbs *AwsAsgEbs) createTags(svc ec2API, resourceId string, tags []*ec2.Tag) error {
+	if awsAsgEbs.TagOverwriteProtection {
+		existing, err := describeResourceTags(svc, resourceId)
+		if err != nil {
+			return err
+		}
+		var skipped []string
+		tags, skipped = withoutExistingTags(tags, existing)
+		if len(skipped) > 0 {
+			log.WithFields(log.Fields{"resource": resourceId, "skipped": skipped}).Info("Not overwriting existing tags")
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	added := []string{}
+	for _, tag := range tags {
+		added = append(added, aws.StringValue(tag.Key))
+	}
+	log.WithFields(log.Fields{"resource": resourceId, "added": added}).Info("Tagging resource")
+
+	createTagsInput := &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(resourceId)},
+		Tags:      tags,
+	}
+	_, err := svc.CreateTags(createTagsInput)
+	return err
+}
+
+// changedTags returns the tags whose key is missing from existing or whose
+// value differs, sorted by key.
+func changedTags(tags map[string]string, existing map[string]string) []*ec2.Tag {
+	keys := []string{}
+	for k, v := range tags {
+		if old, ok := existing[k]; ok && old == v {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	changed := []*ec2.Tag{}
+	for _, k := range keys {
+		changed = append(changed, &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return changed
+}
+
+// describeSnapshotTags returns the tags of the snapshot.
+func describeSnapshotTags(svc ec2API, snapshotId string) (map[string]string, error) {
+	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotId)},
+	}
+	describeSnapshotsOutput, err := svc.DescribeSnapshots(describeSnapshotsInput)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, snapshot := range describeSnapshotsOutput.Snapshots {
+		for _, tag := range snapshot.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+// withSnapshotTags adds snapshotTags to tags, unless tags has the key. The
+// excluded keys and the reserved aws: tags are not copied.
+func withSnapshotTags(tags map[string]string, snapshotTags map[string]string, excluded []string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range snapshotTags {
+		if !strings.HasPrefix(k, "aws:") {
+			merged[k] = v
+		}
+	}
+	for _, key := range excluded {
+		delete(merged, key)
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+// withVolumeTags adds the keys of volumeTags to tags, unless tags has them.
+// Snapshots get the file system tags of their volume this way, so a restore
+// knows what file system the snapshot contains.
+func withVolumeTags(tags map[string]string, volumeTags map[string]string, keys []string) map[string]string {
+	merged := map[string]string{}
+	for _, key := range keys {
+		if value, ok := volumeTags[key]; ok {
+			merged[key] = value
+		}
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithoutExistingTags(t *testing.T) {
+	tags := []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("my-name")},
+		{Key: aws.String("team"), Value: aws.String("storage")},
+		{Key: aws.String("cost-center"), Value: aws.String("42")},
+	}
+	existing := map[string]string{"team": "platform", "owner": "someone"}
+
+	missing, skipped := withoutExistingTags(tags, existing)
+
+	assert.Equal(t, []*ec2.Tag{tags[0], tags[2]}, missing)
+	assert.Equal(t, []string{"team"}, skipped)
+}
+
+func TestChangedTags(t *testing.T) {
+	tags := map[string]string{"Name": "my-name", "team": "storage", "cost-center": "42"}
+	existing := map[string]string{"Name": "my-name", "team": "platform", "owner": "someone"}
+
+	changed := changedTags(tags, existing)
+
+	assert.Equal(t, []*ec2.Tag{
+		{Key: aws.String("cost-center"), Value: aws.String("42")},
+		{Key: aws.String("team"), Value: aws.String("storage")},
+	}, changed)
+}
+
+func TestWithVolumeTags(t *testing.T) {
+	tags := map[string]string{"clone-source": "vol-123456", "mount-point": "/mnt"}
+	volumeTags := map[string]string{"Name": "my-name", "filesystem": "true", "filesystem-type": "ext4"}
+
+	assert.Equal(t, map[string]string{
+		"clone-source":    "vol-123456",
+		"mount-point":     "/mnt",
+		"filesystem":      "true",
+		"filesystem-type": "ext4",
+	}, withVolumeTags(tags, volumeTags, []string{"filesystem", "filesystem-type"}))
+}
+
+func TestWithSnapshotTags(t *testing.T) {
+	tags := map[string]string{"env": "staging"}
+	snapshotTags := map[string]string{"Name": "backup", "filesystem": "true", "env": "production", "owner": "team-data", "aws:backup:source-resource": "vol-123456"}
+
+	assert.Equal(t, map[string]string{
+		"env":   "staging",
+		"owner": "team-data",
+	}, withSnapshotTags(tags, snapshotTags, []string{"Name", "filesystem"}))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// With --thin-pool the volume becomes an LVM volume group, named after the
+// volume id, holding a thin pool and a single thin volume that is formatted
+// and mounted instead of the volume itself. The thin volume may be larger
+// than the pool.
+const (
+	thinPoolName   = "pool"
+	thinVolumeName = "data"
+)
+
+func thinVolumeDevice(volumeGroup string) string {
+	return "/dev/" + volumeGroup + "/" + thinVolumeName
+}
+
+// thinVolumeMapperDevice is the device-mapper name of the thin volume, which
+// is what the mount table shows. LVM doubles the dashes in the names.
+func thinVolumeMapperDevice(volumeGroup string) string {
+	return "/dev/mapper/" + strings.Replace(volumeGroup, "-", "--", -1) + "-" + thinVolumeName
+}
+
+// thinPoolCreateCommands returns the commands that set up the thin pool and
+// thin volume of virtualSize GiB on a new, empty device.
+func thinPoolCreateCommands(device string, volumeGroup string, virtualSize int64) [][]string {
+	return [][]string{
+		{"/sbin/pvcreate", device},
+		{"/sbin/vgcreate", volumeGroup, device},
+		{"/sbin/lvcreate", "--type", "thin-pool", "--extents", "100%FREE", "--name", thinPoolName, volumeGroup},
+		{"/sbin/lvcreate", "--thin", "--virtualsize", fmt.Sprintf("%dG", virtualSize), "--name", thinVolumeName, volumeGroup + "/" + thinPoolName},
+	}
+}
+
+// thinPoolActivateCommands returns the commands that activate the thin pool
+// and thin volume of a reused device.
+func thinPoolActivateCommands(volumeGroup string) [][]string {
+	return [][]string{
+		{"/sbin/vgchange", "--activate", "y", volumeGroup},
+	}
+}
+
+// thinPoolDeactivateCommands returns the commands that deactivate the thin
+// pool and thin volume, so the device can be detached.
+func thinPoolDeactivateCommands(volumeGroup string) [][]string {
+	return [][]string{
+		{"/sbin/vgchange", "--activate", "n", volumeGroup},
+	}
+}
+
+// setupThinPool creates or activates the thin pool on device and returns
+// the device of the thin volume.
+func (awsAsgEbs *AwsAsgEbs) setupThinPool(device string, volumeId string, create bool, virtualSize int64) (string, error) {
+	commands := thinPoolActivateCommands(volumeId)
+	if create {
+		log.WithFields(log.Fields{"device": device, "volume_group": volumeId, "virtual_size": virtualSize}).Info("Creating thin pool")
+		commands = thinPoolCreateCommands(device, volumeId, virtualSize)
+	} else {
+		log.WithFields(log.Fields{"device": device, "volume_group": volumeId}).Info("Activating thin pool")
+	}
+	for _, command := range commands {
+		err := awsAsgEbs.commandRunner().Run(command[0], command[1:]...)
+		if err != nil {
+			return "", err
+		}
+	}
+	return thinVolumeDevice(volumeId), nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) deactivateThinPool(volumeGroup string) error {
+	for _, command := range thinPoolDeactivateCommands(volumeGroup) {
+		err := awsAsgEbs.commandRunner().Run(command[0], command[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
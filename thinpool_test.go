@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThinPoolCreateCommands(t *testing.T) {
+	assert.Equal(t, [][]string{
+		{"/sbin/pvcreate", "/dev/xvdc"},
+		{"/sbin/vgcreate", "vol-123456", "/dev/xvdc"},
+		{"/sbin/lvcreate", "--type", "thin-pool", "--extents", "100%FREE", "--name", "pool", "vol-123456"},
+		{"/sbin/lvcreate", "--thin", "--virtualsize", "400G", "--name", "data", "vol-123456/pool"},
+	}, thinPoolCreateCommands("/dev/xvdc", "vol-123456", 400))
+	assert.Equal(t, "/dev/vol-123456/data", thinVolumeDevice("vol-123456"))
+	assert.Equal(t, "/dev/mapper/vol--123456-data", thinVolumeMapperDevice("vol-123456"))
+}
+
+func TestDeactivateThinPool(t *testing.T) {
+	runner := &fakeRunner{}
+	awsAsgEbs := &AwsAsgEbs{Runner: runner}
+
+	assert.NoError(t, awsAsgEbs.deactivateThinPool(defaultVolumeId))
+	assert.Equal(t, [][]string{{"/sbin/vgchange", "--activate", "n", defaultVolumeId}}, runner.commands)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"syscall"
+)
+
+// fileSystemUsage is the space of a mounted file system in bytes. Free is
+// what is available to unprivileged users, so Used and Free do not add up
+// to Total when blocks are reserved for root.
+type fileSystemUsage struct {
+	Total uint64
+	Used  uint64
+	Free  uint64
+}
+
+func usageFromStatfs(stat syscall.Statfs_t) fileSystemUsage {
+	blockSize := uint64(stat.Bsize)
+	return fileSystemUsage{
+		Total: stat.Blocks * blockSize,
+		Used:  (stat.Blocks - stat.Bfree) * blockSize,
+		Free:  stat.Bavail * blockSize,
+	}
+}
+
+func (awsAsgEbs *AwsAsgEbs) fileSystemUsage(mountPoint string) (fileSystemUsage, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(awsAsgEbs.hostPath(mountPoint), &stat)
+	if err != nil {
+		return fileSystemUsage{}, err
+	}
+	return usageFromStatfs(stat), nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageFromStatfs(t *testing.T) {
+	stat := syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 400, Bavail: 350}
+
+	assert.Equal(t, fileSystemUsage{Total: 4096000, Used: 2457600, Free: 1433600}, usageFromStatfs(stat))
+}
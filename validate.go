@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validateConfig returns every inconsistency between the flags. It does
+// not touch AWS or the instance, so it can run anywhere.
+func validateConfig(cfg Config) []error {
+	problems := []error{}
+
+	if err := validateMountPoints(append([]string{*cfg.mountPoint}, *cfg.bindMountPoints...)); err != nil {
+		problems = append(problems, err)
+	}
+	if (*cfg.tagValue == "") == (*cfg.tagValueFromInstanceTag == "") {
+		problems = append(problems, errors.New("exactly one of --tag-value and --tag-value-from-instance-tag is required"))
+	}
+	if (*cfg.attachAs == "") == !*cfg.autoAttachAs {
+		problems = append(problems, errors.New("exactly one of --attach-as and --auto-attach-as is required"))
+	}
+	if *cfg.cloneVolumeId != "" && len(snapshotTags(cfg)) > 0 {
+		problems = append(problems, errors.New("--clone-volume-id is mutually exclusive with --snapshot-name, --snapshot-tag-value and --snapshot-tag"))
+	}
+	if *cfg.snapshotTagValue != "" && *cfg.snapshotName != "" {
+		problems = append(problems, errors.New("--snapshot-tag-value is mutually exclusive with --snapshot-name"))
+	}
+	if *cfg.snapshotTagKey != "" && *cfg.snapshotTagValue == "" {
+		problems = append(problems, errors.New("--snapshot-tag-key requires --snapshot-tag-value"))
+	}
+	if *cfg.cloneDeleteSnapshot && *cfg.cloneVolumeId == "" {
+		problems = append(problems, errors.New("--clone-delete-snapshot requires --clone-volume-id"))
+	}
+	if *cfg.capacityFallbackVolumeType != "" && !*cfg.capacityRetry {
+		problems = append(problems, errors.New("--capacity-fallback-volume-type requires --capacity-retry"))
+	}
+	if (*cfg.overlayLowerDir == "") != (*cfg.overlayVolumeMountPoint == "") {
+		problems = append(problems, errors.New("--overlay-lowerdir and --overlay-volume-mount-point require each other"))
+	}
+	if err := validateVolumeOptions(*cfg.createVolumeType, *cfg.createSize, *cfg.createIops, *cfg.createThroughput); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateVolumeInitializationRate(*cfg.volumeInitializationRate, *cfg.cloneVolumeId != "" || len(snapshotTags(cfg)) > 0); err != nil {
+		problems = append(problems, err)
+	}
+	// --ensure-tags overwrites exactly the tags the protection keeps.
+	if *cfg.ensureTags && *cfg.tagOverwriteProtection {
+		problems = append(problems, errors.New("--ensure-tags and --create-tags-overwrite-protection are mutually exclusive"))
+	}
+	if *cfg.kmsKeyId != "" && !*cfg.encrypted {
+		problems = append(problems, errors.New("--kms-key-id requires --encrypted"))
+	}
+	if *cfg.attachRetries < 1 {
+		problems = append(problems, errors.New("--attach-retries must be at least 1"))
+	}
+	if *cfg.snapshotOnExit && !*cfg.daemon {
+		problems = append(problems, errors.New("--snapshot-on-exit requires --daemon"))
+	}
+	if *cfg.detachOnExit && !*cfg.daemon {
+		problems = append(problems, errors.New("--detach-on-exit requires --daemon"))
+	}
+	if *cfg.waitForSnapshot && !*cfg.snapshotOnExit {
+		problems = append(problems, errors.New("--wait-for-snapshot requires --snapshot-on-exit"))
+	}
+	if *cfg.persistFstab && *cfg.systemdMount {
+		problems = append(problems, errors.New("--persist-fstab and --systemd-mount are mutually exclusive"))
+	}
+	if *cfg.fsUuidOnReuse && *cfg.fsUuid == "" {
+		problems = append(problems, errors.New("--fs-uuid-on-reuse requires --fs-uuid"))
+	}
+	if err := validateSnapshotOwner(*cfg.snapshotOwner); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateBlockSize(newMkfsConfig(cfg).fsType, *cfg.mkfsBlockSize); err != nil {
+		problems = append(problems, err)
+	}
+	if *cfg.mountProfile != "" {
+		if _, err := mountProfileOptions(*cfg.mountProfile, *cfg.filesystemType); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if *cfg.readOnly {
+		problems = append(problems, validateReadOnly(cfg)...)
+	}
+	if *cfg.multiAttach {
+		problems = append(problems, validateMultiAttach(cfg)...)
+	}
+	if *cfg.verityRootHash != "" {
+		problems = append(problems, validateVerity(cfg)...)
+	} else if *cfg.verityHashOffset != 0 {
+		problems = append(problems, errors.New("--verity-hash-offset requires --verity-root-hash"))
+	}
+	if isClusterFileSystem(*cfg.filesystemType) && !*cfg.multiAttach {
+		problems = append(problems, fmt.Errorf("--filesystem-type %s requires --multi-attach", *cfg.filesystemType))
+	}
+	if *cfg.filesystemType == "gfs2" {
+		if err := validateLockTable(*cfg.clusterLockTable); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if isClusterFileSystem(*cfg.filesystemType) && *cfg.fsUuid != "" {
+		problems = append(problems, fmt.Errorf("--fs-uuid is not supported for %s", *cfg.filesystemType))
+	}
+	if *cfg.fsUuid != "" {
+		if err := validateUUID(*cfg.fsUuid); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// validateReadOnly returns the flags that have no effect with --read-only.
+// A read-only volume is reused or restored from a snapshot with its file
+// system as is, it is never formatted.
+func validateReadOnly(cfg Config) []error {
+	problems := []error{}
+	ignored := []string{}
+	if *cfg.forceFormat {
+		ignored = append(ignored, "--force-format")
+	}
+	if *cfg.mkfsOptions != "" {
+		ignored = append(ignored, "--mkfs-options")
+	}
+	if *cfg.mkfsBlockSize != 0 {
+		ignored = append(ignored, "--mkfs-block-size")
+	}
+	if *cfg.mkfsIonice {
+		ignored = append(ignored, "--mkfs-ionice")
+	}
+	if *cfg.fsUuid != "" {
+		ignored = append(ignored, "--fs-uuid")
+	}
+	if *cfg.autoResize {
+		ignored = append(ignored, "--auto-resize")
+	}
+	if len(ignored) > 0 {
+		problems = append(problems, fmt.Errorf("--read-only never creates or changes the file system, remove %s", strings.Join(ignored, ", ")))
+	}
+	if *cfg.multiAttach {
+		problems = append(problems, errors.New("--read-only and --multi-attach are mutually exclusive, the first instance formats the cluster volume"))
+	}
+	return problems
+}
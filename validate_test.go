@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	assert.Empty(t, validateConfig(*newConfig()))
+}
+
+func TestValidateConfigReportsAllProblems(t *testing.T) {
+	cfg := newConfig()
+	cfg.autoAttachAs = boolPtr(true)
+	cfg.cloneVolumeId = strPtr("vol-source")
+	cfg.snapshotName = strPtr("my-name")
+	cfg.fsUuid = strPtr("not-a-uuid")
+
+	assert.Len(t, validateConfig(*cfg), 3)
+}
+
+func TestValidateConfigTagValueSource(t *testing.T) {
+	cfg := newConfig()
+	cfg.tagValueFromInstanceTag = strPtr("DataVolumeName")
+	assert.Len(t, validateConfig(*cfg), 1)
+
+	cfg.tagValue = strPtr("")
+	assert.Empty(t, validateConfig(*cfg))
+
+	cfg.tagValueFromInstanceTag = strPtr("")
+	assert.Len(t, validateConfig(*cfg), 1)
+}
+
+func TestValidateConfigVolumeInitializationRate(t *testing.T) {
+	cfg := newConfig()
+	cfg.volumeInitializationRate = int64Ptr(200)
+	assert.Len(t, validateConfig(*cfg), 1)
+
+	cfg.cloneVolumeId = strPtr("vol-source")
+	assert.Empty(t, validateConfig(*cfg))
+}
+
+func TestValidateConfigMountProfile(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountProfile = strPtr("throughput")
+	assert.Empty(t, validateConfig(*cfg))
+
+	cfg.filesystemType = strPtr("ext3")
+	assert.Len(t, validateConfig(*cfg), 1)
+}
+
+func TestValidateConfigEnsureTagsWithOverwriteProtection(t *testing.T) {
+	cfg := newConfig()
+	cfg.ensureTags = boolPtr(true)
+	cfg.tagOverwriteProtection = boolPtr(true)
+	assert.Len(t, validateConfig(*cfg), 1)
+}
+
+func TestValidateConfigDetachOnExit(t *testing.T) {
+	cfg := newConfig()
+	cfg.detachOnExit = boolPtr(true)
+	assert.Len(t, validateConfig(*cfg), 1)
+
+	cfg.daemon = boolPtr(true)
+	assert.Empty(t, validateConfig(*cfg))
+}
+
+func TestValidateConfigReadOnly(t *testing.T) {
+	cfg := newConfig()
+	cfg.readOnly = boolPtr(true)
+	assert.Empty(t, validateConfig(*cfg))
+
+	cfg.forceFormat = boolPtr(true)
+	cfg.mkfsOptions = strPtr("-m 0")
+	assert.Len(t, validateConfig(*cfg), 1)
+}
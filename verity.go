@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// With --verity-root-hash a read-only volume is mounted through a dm-verity
+// device that checks every block it reads against the hash tree. The hash
+// tree is stored on the volume itself, right after the file system at
+// --verity-hash-offset bytes, so the snapshot must have been built with
+// `veritysetup format --hash-offset`. Blocks that do not match fail to read.
+
+// rootHashPattern matches the hex root hash of sha256 or sha512.
+var rootHashPattern = regexp.MustCompile(`^([0-9a-f]{64}|[0-9a-f]{128})$`)
+
+func verityName(volumeId string) string {
+	return "verity-" + volumeId
+}
+
+func verityDevice(volumeId string) string {
+	return "/dev/mapper/" + verityName(volumeId)
+}
+
+// verityOpenCommand returns the command that sets up the dm-verity device of
+// the volume on device. It fails if the hash tree does not match rootHash.
+func verityOpenCommand(device string, volumeId string, rootHash string, hashOffset int64) []string {
+	return []string{"/sbin/veritysetup", "open", fmt.Sprintf("--hash-offset=%d", hashOffset), device, verityName(volumeId), device, rootHash}
+}
+
+func verityCloseCommand(volumeId string) []string {
+	return []string{"/sbin/veritysetup", "close", verityName(volumeId)}
+}
+
+// openVerity sets up the dm-verity device over device and returns it.
+func (awsAsgEbs *AwsAsgEbs) openVerity(device string, volumeId string, rootHash string, hashOffset int64) (string, error) {
+	log.WithFields(log.Fields{"device": device, "root_hash": rootHash, "hash_offset": hashOffset}).Info("Setting up dm-verity device")
+	command := verityOpenCommand(device, volumeId, rootHash, hashOffset)
+	err := awsAsgEbs.commandRunner().Run(command[0], command[1:]...)
+	if err != nil {
+		return "", err
+	}
+	return verityDevice(volumeId), nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) closeVerity(volumeId string) error {
+	command := verityCloseCommand(volumeId)
+	return awsAsgEbs.commandRunner().Run(command[0], command[1:]...)
+}
+
+// validateVerity returns the problems of --verity-root-hash with the other
+// flags.
+func validateVerity(cfg Config) []error {
+	problems := []error{}
+	if !rootHashPattern.MatchString(*cfg.verityRootHash) {
+		problems = append(problems, fmt.Errorf("invalid --verity-root-hash '%s', must be a lower case hex sha256 or sha512 hash", *cfg.verityRootHash))
+	}
+	if *cfg.verityHashOffset <= 0 {
+		problems = append(problems, errors.New("--verity-root-hash requires --verity-hash-offset"))
+	}
+	if !*cfg.readOnly {
+		problems = append(problems, errors.New("--verity-root-hash requires --read-only"))
+	}
+	if *cfg.thinPool {
+		problems = append(problems, errors.New("--verity-root-hash and --thin-pool are mutually exclusive"))
+	}
+	// Neither sets up the dm-verity device on boot.
+	if *cfg.persistFstab || *cfg.systemdMount {
+		problems = append(problems, errors.New("--verity-root-hash cannot be combined with --persist-fstab or --systemd-mount"))
+	}
+	return problems
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var defaultRootHash = strings.Repeat("ab", 32)
+
+func TestVerityOpenCommand(t *testing.T) {
+	assert.Equal(t, []string{"/sbin/veritysetup", "open", "--hash-offset=107374182400", "/dev/xvdc", "verity-vol-123456", "/dev/xvdc", defaultRootHash},
+		verityOpenCommand("/dev/xvdc", "vol-123456", defaultRootHash, 107374182400))
+	assert.Equal(t, "/dev/mapper/verity-vol-123456", verityDevice("vol-123456"))
+}
+
+func TestValidateConfigVerity(t *testing.T) {
+	cfg := newConfig()
+	cfg.verityRootHash = strPtr(defaultRootHash)
+	cfg.verityHashOffset = int64Ptr(1 << 30)
+	cfg.readOnly = boolPtr(true)
+	assert.Empty(t, validateConfig(*cfg))
+
+	cfg.verityRootHash = strPtr("ABC")
+	cfg.verityHashOffset = int64Ptr(0)
+	cfg.readOnly = boolPtr(false)
+	cfg.thinPool = boolPtr(true)
+	assert.Len(t, validateConfig(*cfg), 4)
+
+	cfg = newConfig()
+	cfg.verityHashOffset = int64Ptr(1 << 30)
+	assert.Len(t, validateConfig(*cfg), 1)
+}
+
+func TestVerityMountsVerityDevice(t *testing.T) {
+	cfg := newConfig()
+	cfg.readOnly = boolPtr(true)
+	cfg.verityRootHash = strPtr(defaultRootHash)
+	cfg.verityHashOffset = int64Ptr(1 << 30)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("openVerity", "/dev/"+*cfg.attachAs, defaultVolumeId, defaultRootHash, int64(1<<30)).
+		Return(verityDevice(defaultVolumeId), nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", verityDevice(defaultVolumeId), *cfg.mountPoint)
+}
+
+func TestSkipIfMountedWithVerity(t *testing.T) {
+	cfg := newConfig()
+	cfg.skipIfMounted = boolPtr(true)
+	cfg.readOnly = boolPtr(true)
+	cfg.verityRootHash = strPtr(defaultRootHash)
+	cfg.verityHashOffset = int64Ptr(1 << 30)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("lookupMount", *cfg.mountPoint).
+		Return(&mountInfo{MountPoint: *cfg.mountPoint, Source: verityDevice(defaultVolumeId), FsType: "ext4"}, nil)
+	fakeAsgEbs.
+		On("attachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, false, nil)
+
+	assert.NoError(t, runAsgEbs(fakeAsgEbs, *cfg))
+	fakeAsgEbs.AssertNotCalled(t, "openVerity", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// volumeTypes are the volume types createVolume can create.
+var volumeTypes = []string{"standard", "gp2", "gp3", "io1", "io2"}
+
+// maxIopsPerGiB limits the provisioned IOPS of a volume by its size for the
+// volume types that require provisioned IOPS.
+var maxIopsPerGiB = map[string]int64{
+	"io1": 50,
+	"io2": 500,
+}
+
+func supportsIops(volumeType string) bool {
+	_, provisioned := maxIopsPerGiB[volumeType]
+	return provisioned || volumeType == "gp3"
+}
+
+func supportsThroughput(volumeType string) bool {
+	return volumeType == "gp3"
+}
+
+// supportsMultiAttach reports whether volumes of the type can be attached to
+// several instances at once.
+func supportsMultiAttach(volumeType string) bool {
+	return volumeType == "io1" || volumeType == "io2"
+}
+
+// validateVolumeOptions rejects --create-iops and --create-throughput for
+// volume types that do not support them and IOPS that do not fit the size
+// instead of leaving it to EC2.
+func validateVolumeOptions(volumeType string, size int64, iops int64, throughput int64) error {
+	if iops != 0 && !supportsIops(volumeType) {
+		return fmt.Errorf("--create-iops is not supported for %s volumes", volumeType)
+	}
+	if maxPerGiB, ok := maxIopsPerGiB[volumeType]; ok {
+		if iops == 0 {
+			return fmt.Errorf("--create-iops is required for %s volumes", volumeType)
+		}
+		if iops > maxPerGiB*size {
+			return fmt.Errorf("%d IOPS exceed the %d:1 IOPS to size ratio of %s volumes for %d GiB", iops, maxPerGiB, volumeType, size)
+		}
+	}
+	if throughput != 0 && !supportsThroughput(volumeType) {
+		return fmt.Errorf("--create-throughput is not supported for %s volumes", volumeType)
+	}
+	return nil
+}
+
+// The range of --volume-initialization-rate in MiB/s.
+const (
+	minVolumeInitializationRate = 100
+	maxVolumeInitializationRate = 300
+)
+
+// validateVolumeInitializationRate rejects a rate outside of what EBS
+// accepts and a rate for volumes that are not created from a snapshot, which
+// need no initialization. 0 leaves the volume to lazy loading.
+func validateVolumeInitializationRate(rate int64, fromSnapshot bool) error {
+	if rate == 0 {
+		return nil
+	}
+	if !fromSnapshot {
+		return errors.New("--volume-initialization-rate requires a snapshot, set --snapshot-name, --snapshot-tag-value, --snapshot-tag or --clone-volume-id")
+	}
+	if rate < minVolumeInitializationRate || rate > maxVolumeInitializationRate {
+		return fmt.Errorf("invalid volume initialization rate %d MiB/s, must be from %d to %d", rate, minVolumeInitializationRate, maxVolumeInitializationRate)
+	}
+	return nil
+}
+
+// addCreateVolumeParameters sets the options of a CreateVolume request the
+// vendored SDK has no fields for. They were added after its API version, so
+// the request is sent with the newer one.
+func (awsAsgEbs *AwsAsgEbs) addCreateVolumeParameters(req *request.Request, volumeType string, fromSnapshot bool) {
+	added := false
+	if awsAsgEbs.CreateThroughput != 0 && supportsThroughput(volumeType) {
+		req.Handlers.Build.PushBack(withQueryParameter("Throughput", strconv.FormatInt(awsAsgEbs.CreateThroughput, 10)))
+		added = true
+	}
+	if awsAsgEbs.MultiAttach && supportsMultiAttach(volumeType) {
+		req.Handlers.Build.PushBack(withQueryParameter("MultiAttachEnabled", "true"))
+		added = true
+	}
+	if awsAsgEbs.VolumeInitializationRate != 0 && fromSnapshot {
+		req.Handlers.Build.PushBack(withQueryParameter("VolumeInitializationRate", strconv.FormatInt(awsAsgEbs.VolumeInitializationRate, 10)))
+		added = true
+	}
+	if added {
+		req.Handlers.Build.PushBack(withQueryParameter("Version", modifyVolumeAPIVersion))
+	}
+}
+
+// withQueryParameter is a Build handler setting a parameter of an EC2
+// request the vendored SDK does not know, e.g. Throughput of CreateVolume.
+// It has to run after the EC2 query protocol encoded the body.
+func withQueryParameter(name string, value string) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed reading EC2 Query request", err)
+			return
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed decoding EC2 Query request", err)
+			return
+		}
+		values.Set(name, value)
+		r.SetBufferBody([]byte(values.Encode()))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateVolumeOptions(t *testing.T) {
+	assert.NoError(t, validateVolumeOptions("gp2", 200, 0, 0))
+	assert.NoError(t, validateVolumeOptions("gp3", 200, 6000, 250))
+	assert.Error(t, validateVolumeOptions("gp2", 200, 6000, 0))
+	assert.Error(t, validateVolumeOptions("standard", 200, 0, 250))
+}
+
+func TestValidateVolumeOptionsProvisionedIops(t *testing.T) {
+	assert.NoError(t, validateVolumeOptions("io1", 200, 10000, 0))
+	assert.NoError(t, validateVolumeOptions("io2", 200, 64000, 0))
+	assert.Error(t, validateVolumeOptions("io1", 200, 0, 0))
+	assert.Error(t, validateVolumeOptions("io1", 200, 10001, 0))
+	assert.Error(t, validateVolumeOptions("io2", 100, 50001, 250))
+}
+
+func TestWithQueryParameter(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().WithRegion("eu-west-1")))
+	req, _ := svc.CreateVolumeRequest(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(defaultAvailabilityZone),
+		Size:             aws.Int64(200),
+		VolumeType:       aws.String("gp3"),
+	})
+	req.Handlers.Build.PushBack(withQueryParameter("Throughput", "250"))
+
+	assert.NoError(t, req.Build())
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "250", values.Get("Throughput"))
+	assert.Equal(t, "gp3", values.Get("VolumeType"))
+}
+
+func TestValidateVolumeInitializationRate(t *testing.T) {
+	assert.NoError(t, validateVolumeInitializationRate(0, false))
+	assert.NoError(t, validateVolumeInitializationRate(200, true))
+	assert.Error(t, validateVolumeInitializationRate(200, false))
+	assert.Error(t, validateVolumeInitializationRate(50, true))
+	assert.Error(t, validateVolumeInitializationRate(301, true))
+}
+
+func TestAddCreateVolumeParameters(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().WithRegion("eu-west-1")))
+	awsAsgEbs := &AwsAsgEbs{VolumeInitializationRate: 200}
+
+	req, _ := svc.CreateVolumeRequest(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(defaultAvailabilityZone),
+		SnapshotId:       aws.String("snap-1"),
+		VolumeType:       aws.String("gp2"),
+	})
+	awsAsgEbs.addCreateVolumeParameters(req, "gp2", true)
+	assert.NoError(t, req.Build())
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "200", values.Get("VolumeInitializationRate"))
+	assert.Equal(t, modifyVolumeAPIVersion, values.Get("Version"))
+	assert.Equal(t, "", values.Get("Throughput"))
+
+	req, _ = svc.CreateVolumeRequest(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(defaultAvailabilityZone),
+		Size:             aws.Int64(200),
+		VolumeType:       aws.String("gp2"),
+	})
+	awsAsgEbs.addCreateVolumeParameters(req, "gp2", false)
+	assert.NoError(t, req.Build())
+	body, err = io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err = url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "", values.Get("VolumeInitializationRate"))
+	assert.Equal(t, "2015-10-01", values.Get("Version"))
+}
+
+func TestAddCreateVolumeParametersMultiAttach(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().WithRegion("eu-west-1")))
+	awsAsgEbs := &AwsAsgEbs{MultiAttach: true}
+
+	req, _ := svc.CreateVolumeRequest(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(defaultAvailabilityZone),
+		Size:             aws.Int64(200),
+		VolumeType:       aws.String("io2"),
+	})
+	awsAsgEbs.addCreateVolumeParameters(req, "io2", false)
+	assert.NoError(t, req.Build())
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "true", values.Get("MultiAttachEnabled"))
+	assert.Equal(t, modifyVolumeAPIVersion, values.Get("Version"))
+}
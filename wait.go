@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// waitForVolumeState blocks until the volume is in state, which is either
+// "available" or "in-use". The AWS waiters give up on their own after 10
+// minutes, so timeout can only shorten the wait.
+func waitForVolumeState(asgEbs AsgEbs, volumeId string, state string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		switch state {
+		case "available":
+			done <- asgEbs.waitUntilVolumeAvailable(volumeId)
+		case "in-use":
+			done <- asgEbs.waitUntilVolumeInUse(volumeId)
+		default:
+			done <- fmt.Errorf("unknown volume state %s", state)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("volume %s did not become %s within %s", volumeId, state, timeout)
+	}
+}
+
+// detachAndWait detaches the volume and waits at most timeout until it is
+// available. A volume still in use is typically stuck "detaching" because
+// the instance holds on to the device, it is left for an operator.
+func detachAndWait(asgEbs AsgEbs, volumeId string, timeout time.Duration) error {
+	err := asgEbs.detachVolume(volumeId)
+	if err != nil {
+		return err
+	}
+	err = waitForVolumeState(asgEbs, volumeId, "available", timeout)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId, "timeout": timeout}).Error("Volume is stuck detaching")
+		return wrapError(ErrVolumeNotAvailable, err)
+	}
+	return nil
+}
+
+var attachPollInterval = 5 * time.Second
+
+// attachmentState returns the state of the attachment of volume to
+// instanceId, or "" if it is not attached to it.
+func attachmentState(volume *ec2.Volume, instanceId string) string {
+	for _, attachment := range volume.Attachments {
+		if aws.StringValue(attachment.InstanceId) == instanceId {
+			return aws.StringValue(attachment.State)
+		}
+	}
+	return ""
+}
+
+// waitUntilAttached polls the volume until its attachment to this instance
+// is "attached". The in-use waiter also succeeds when the volume is in use
+// by another instance.
+func (awsAsgEbs *AwsAsgEbs) waitUntilAttached(svc ec2API, volumeId string) error {
+	timeout := awsAsgEbs.AttachTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	describeVolumesInput := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	}
+	for {
+		describeVolumesOutput, err := svc.DescribeVolumes(describeVolumesInput)
+		if err != nil {
+			return err
+		}
+		if len(describeVolumesOutput.Volumes) == 0 {
+			return fmt.Errorf("volume %s not found", volumeId)
+		}
+		state := attachmentState(describeVolumesOutput.Volumes[0], awsAsgEbs.InstanceId)
+		if state == "attached" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("volume %s was not attached to %s within %s, attachment state %q", volumeId, awsAsgEbs.InstanceId, timeout, state)
+		}
+		log.WithFields(log.Fields{"volume": volumeId, "state": state}).Debug("Waiting for attachment")
+		time.Sleep(attachPollInterval)
+	}
+}
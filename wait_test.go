@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForVolumeState(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("waitUntilVolumeInUse", defaultVolumeId).Return(nil)
+
+	assert.NoError(t, waitForVolumeState(fakeAsgEbs, defaultVolumeId, "in-use", time.Second))
+	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeInUse", defaultVolumeId)
+}
+
+func TestWaitForVolumeStateTimeout(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(newConfig())
+	fakeAsgEbs.On("waitUntilVolumeAvailable", defaultVolumeId).After(time.Second).Return(nil)
+
+	assert.Error(t, waitForVolumeState(fakeAsgEbs, defaultVolumeId, "available", 10*time.Millisecond))
+}
+
+func TestAttachmentState(t *testing.T) {
+	volume := &ec2.Volume{
+		Attachments: []*ec2.VolumeAttachment{
+			{InstanceId: aws.String("i-other"), State: aws.String("attached")},
+			{InstanceId: aws.String("i-self"), State: aws.String("attaching")},
+		},
+	}
+
+	assert.Equal(t, "attaching", attachmentState(volume, "i-self"))
+	assert.Equal(t, "", attachmentState(volume, "i-unknown"))
+}
+
+func TestWaitUntilAttached(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{
+		InstanceId: "i-self",
+		EC2: &fakeEC2{volume: &ec2.Volume{
+			VolumeId:    aws.String(defaultVolumeId),
+			Attachments: []*ec2.VolumeAttachment{{InstanceId: aws.String("i-self"), State: aws.String("attached")}},
+		}},
+	}
+
+	assert.NoError(t, awsAsgEbs.waitUntilAttached(awsAsgEbs.ec2Client(), defaultVolumeId))
+}
+
+func TestWaitUntilAttachedTimeout(t *testing.T) {
+	awsAsgEbs := &AwsAsgEbs{
+		InstanceId:    "i-self",
+		AttachTimeout: time.Nanosecond,
+		EC2: &fakeEC2{volume: &ec2.Volume{
+			VolumeId:    aws.String(defaultVolumeId),
+			Attachments: []*ec2.VolumeAttachment{{InstanceId: aws.String("i-other"), State: aws.String("attached")}},
+		}},
+	}
+
+	assert.Error(t, awsAsgEbs.waitUntilAttached(awsAsgEbs.ec2Client(), defaultVolumeId))
+}